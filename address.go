@@ -1,11 +1,12 @@
 package gosmtp
 
 import (
-	"bytes"
 	"fmt"
 	"net"
 	"net/mail"
 	"strings"
+
+	"golang.org/x/net/idna"
 )
 
 func parseAddress(src string) (*mail.Address, error) {
@@ -16,14 +17,26 @@ func parseAddress(src string) (*mail.Address, error) {
 	return addr, nil
 }
 
+// hostname returns domain of the address, empty for the null sender and the bare postmaster
 func hostname(addr *mail.Address) string {
-	// if the mail address didn't have @ it would be caught by parseAddress
-	return string(bytes.Split([]byte(addr.Address), []byte{'@'})[1])
+	if i := strings.LastIndexByte(addr.Address, '@'); i >= 0 {
+		return addr.Address[i+1:]
+	}
+	return ""
 }
 
 // IsFQN checks if email host is full qualified name (MX or A record)
+// the null sender and address literals are not checked
 func IsFQN(addr *mail.Address) string {
-	ok, err := fqn(hostname(addr))
+	host := hostname(addr)
+	if host == "" || strings.HasPrefix(host, "[") {
+		return ""
+	}
+	// U-labels of SMTPUTF8 domains are resolved as A-labels
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+	ok, err := fqn(host)
 	if err != nil {
 		return Codes.ErrorUnableToResolveHost
 	} else if !ok {
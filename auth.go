@@ -1,154 +1,331 @@
 package gosmtp
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"strings"
-	"unicode"
+	"time"
 )
 
 /*
-SupportedAuthMechanisms is array of string describing currently supported/implemented
-authentication mechanisms
+RFC 4954, SMTP Service Extension for Authentication
+
+	auth-command = "AUTH" SP sasl-mech [SP initial-response] *(CRLF [base64]) [CRLF cancel-response] CRLF
+	initial-response = base64 / "="
+	cancel-response = "*"
+
+	If the client wishes to cancel the authentication exchange, it issues a line
+	with a single "*".  If the server receives such a response, it MUST reject
+	the AUTH command by sending a 501 reply.
+
+The server challenges are sent in 334 replies, the exchange itself is driven by SASLServer.
 */
-var SupportedAuthMechanisms = []string{"LOGIN", "PLAIN"}
 
-func (s *session) handleLoginAuth(cmd *command) {
-	args := cmd.arguments
-	var username string
-	var password []byte
-	if len(args) == 1 {
-		line, err := s.ReadLine()
-		if err != nil {
-			s.state = sessionStateAborted
-			return
+var (
+	// ErrAuthFailed is returned by SASLServer if the credentials are wrong, the client gets 535 reply
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrAuthMalformed is returned by SASLServer if the client response can't be parsed, the client gets 501 reply
+	ErrAuthMalformed = errors.New("malformed authentication response")
+)
+
+// SASLMechanism is a server side SASL mechanism which can be registered by Server.Auth
+type SASLMechanism interface {
+	// Name returns the mechanism name announced in EHLO, e.g. CRAM-MD5
+	Name() string
+	// Start begins new authentication exchange of the peer
+	Start(peer *Peer) SASLServer
+}
+
+// SASLServer is one authentication exchange of SASLMechanism
+type SASLServer interface {
+	// Next processes the client response and returns the next challenge, response is nil if the client
+	// didn't send initial response. Once done is returned, peer.Username is the authenticated user,
+	// peer.AuthorizationID the identity requested by the client, if any, and challenge, if any,
+	// is the additional data sent with the success. Both are cleared if the authentication fails.
+	// Return ErrAuthFailed for wrong credentials, ErrAuthMalformed for invalid response or Error for exact reply,
+	// the session is aborted on other errors.
+	Next(ctx context.Context, response []byte) (challenge []byte, done bool, err error)
+}
+
+// saslRejecter is implemented by SASLServer which rejects credentials by an error challenge,
+// e.g. OAUTHBEARER, the client may cancel the exchange instead of acknowledging the error
+type saslRejecter interface {
+	// rejected returns if the error challenge was sent
+	rejected() bool
+}
+
+// PasswordAuthenticator checks password of peer.Username
+type PasswordAuthenticator func(ctx context.Context, peer *Peer, password []byte) (bool, error)
+
+// handleSASL runs the SASL exchange of the mechanism selected by the client,
+// the identity set by the mechanism is kept on the peer only if the authentication succeeds
+func (s *session) handleSASL(mech SASLMechanism, args []string) {
+	defer func() {
+		if !s.peer.Authenticated {
+			s.peer.Username, s.peer.AuthorizationID = "", ""
 		}
-		cmd := strings.TrimRightFunc(line, unicode.IsSpace)
-		s.log.Printf("INFO: received AUTH cmd: '%s'", cmd)
-		data, err := base64.StdEncoding.DecodeString(cmd)
-		if err != nil {
-			s.Out("501 malformed auth input")
-			s.badCommandsCount++
+	}()
+	s.peer.Username, s.peer.AuthorizationID = "", ""
+	if s.authLockedOut() {
+		return
+	}
+	server := mech.Start(s.peer)
+
+	var response []byte
+	if len(args) > 1 {
+		var ok bool
+		if response, ok = s.decodeSASL(args[1]); !ok {
 			return
 		}
-		username = string(data)
-		s.Out("334 UGFzc3dvcmQ6")
-		line, err = s.ReadLine()
-		if err != nil {
-			s.state = sessionStateAborted
-			return
+	}
+
+	for {
+		ctx, done := s.hookContext(s.listener.Limits.CmdInput)
+		challenge, finished, err := server.Next(ctx, response)
+		done()
+		if (err == nil && finished) || errors.Is(err, ErrAuthFailed) {
+			// the user is known now
+			if s.authLockedOut() {
+				return
+			}
 		}
-		cmd = strings.TrimRightFunc(line, unicode.IsSpace)
-		s.log.Printf("INFO: received second AUTH cmd: '%s'", cmd)
-		password, err = base64.StdEncoding.DecodeString(cmd)
-		if err != nil {
-			s.Out("501 malformed auth input")
-			return
+		if err == nil && finished {
+			err = s.authorize()
 		}
-	} else if len(args) == 2 {
-		data, err := base64.StdEncoding.DecodeString(args[1])
 		if err != nil {
-			s.Out("501 malformed auth input")
+			s.saslError(err)
 			return
 		}
-		username = string(data)
-		s.Out("334 UGFzc3dvcmQ6")
+		if finished && challenge == nil {
+			break
+		}
+
+		s.Out("334 " + base64.StdEncoding.EncodeToString(challenge))
+		s.setReadDeadline(time.Now().Add(s.listener.Limits.CmdInput))
 		line, err := s.ReadLine()
 		if err != nil {
-			s.Out(Codes.FailLineTooLong)
-			s.badCommandsCount++
+			s.state = sessionStateAborted
 			return
 		}
-		cmd := strings.TrimRightFunc(line, unicode.IsSpace)
-		s.log.Printf("INFO: received second AUTH cmd: '%s'", cmd)
-		password, err = base64.StdEncoding.DecodeString(cmd)
-		if err != nil {
-			s.Out("501 malformed auth input")
-			s.state = sessionStateAborted
+		s.log.Printf("INFO: received AUTH response")
+		line = strings.TrimSpace(line)
+		if line == "*" {
+			// the credentials were rejected already, cancelling doesn't save the client from the failure
+			if r, ok := server.(saslRejecter); ok && r.rejected() {
+				s.authFailed()
+			}
+			s.Out(Codes.FailAuthCancelled)
+			return
+		}
+		if finished {
+			// the client acknowledges the additional data with empty response
+			if line != "" {
+				s.Out(Codes.FailAuthMalformed)
+				s.badCommandsCount++
+				return
+			}
+			break
+		}
+		var ok bool
+		if response, ok = s.decodeSASL(line); !ok {
 			return
 		}
 	}
 
-	// check login
-	s.peer.Username = username
-	ok, err := s.srv.Authenticator(s.peer, password)
+	s.authSucceeded()
+	s.peer.Authenticated = true
+	s.Out(Codes.SuccessAuthentication)
+}
+
+// authorize checks if the authenticated user may act as the authorization identity requested by the client
+func (s *session) authorize() error {
+	if s.peer.AuthorizationID == s.peer.Username {
+		s.peer.AuthorizationID = ""
+	}
+	if s.peer.AuthorizationID == "" {
+		return nil
+	}
+	if s.srv.Authorizer == nil {
+		return ErrAuthFailed
+	}
+	ctx, done := s.hookContext(s.listener.Limits.CmdInput)
+	defer done()
+	ok, err := s.srv.Authorizer(ctx, s.peer, s.peer.AuthorizationID)
 	if err != nil {
-		s.Out(Codes.ErrorAuth)
-		s.state = sessionStateAborted
-		return
+		return err
 	}
 	if !ok {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// decodeSASL decodes base64 client response, "=" is empty initial response
+func (s *session) decodeSASL(line string) ([]byte, bool) {
+	if line == "=" {
+		return []byte{}, true
+	}
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		s.Out(Codes.FailAuthMalformed)
+		s.badCommandsCount++
+		return nil, false
+	}
+	return data, true
+}
+
+// parseMailAuth parses AUTH parameter of MAIL command, returns empty mailbox for <>
+func parseMailAuth(value string) (string, error) {
+	// auth-param = "AUTH=" xtext, the unencoded value is "<>" or mailbox
+	mailbox, err := decodeXtext(value)
+	if err != nil {
+		return "", err
+	}
+	if mailbox == "<>" {
+		return "", nil
+	}
+	return parseMailbox(mailbox)
+}
+
+// saslError replies to error returned by SASLServer
+func (s *session) saslError(err error) {
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		s.authFailed()
 		s.Out(Codes.FailAuthentication)
-		return
+	case errors.Is(err, ErrAuthMalformed):
+		s.Out(Codes.FailAuthMalformed)
+		s.badCommandsCount++
+	default:
+		s.authError(err)
 	}
+}
 
-	// login succeeded
-	s.peer.Authenticated = true
-	s.Out(Codes.SuccessAuthentication)
-	return
+// authError replies to error returned by Authenticator, the session is aborted unless it's an Error
+func (s *session) authError(err error) {
+	var smtpErr *Error
+	if errors.As(err, &smtpErr) {
+		s.Out(smtpErr.Error())
+		return
+	}
+	s.Out(Codes.ErrorAuth)
+	s.state = sessionStateAborted
 }
 
-func (s *session) handlePlainAuth(cmd *command) {
-	args := cmd.arguments
-	var authData []byte
-	var err error
-	// check that PLAIN auth input is of valid form
-	if len(args) == 1 {
-		s.Out("334")
-		line, err := s.ReadLine()
-		if err != nil {
-			s.state = sessionStateAborted
-			return
-		}
-		cmd, err := parseCommand(strings.TrimRightFunc(line, unicode.IsSpace))
-		s.log.Printf("INFO: received AUTH cmd: '%s'", cmd)
-		if err != nil {
-			s.Out(Codes.FailUnrecognizedCmd)
-			s.badCommandsCount++
-			return
-		}
-		authData, err = base64.StdEncoding.DecodeString(cmd.arguments[0])
-		if err != nil {
-			s.Out("501 malformed auth input")
-			s.badCommandsCount++
-			return
-		}
-	} else if len(args) == 2 {
-		authData, err = base64.StdEncoding.DecodeString(args[1])
-		if err != nil {
-			s.Out("501 malformed auth input")
-			s.badCommandsCount++
-			return
+// authMechanism returns the registered mechanism of the name, nil if there's none or it's not offered
+func (s *session) authMechanism(name string) SASLMechanism {
+	for _, mech := range s.srv.authMechanisms {
+		if strings.EqualFold(mech.Name(), name) && s.mechanismOffered(mech) {
+			return mech
 		}
 	}
+	return nil
+}
 
-	// split
-	t := make([][]byte, 3)
-	i := 0
-	for _, b := range authData {
-		if b == 0 {
-			i++
-			continue
+// authMechanismNames returns names of the mechanisms announced to the client
+func (s *session) authMechanismNames() []string {
+	names := make([]string, 0, len(s.srv.authMechanisms))
+	for _, mech := range s.srv.authMechanisms {
+		if s.mechanismOffered(mech) {
+			names = append(names, mech.Name())
 		}
-		t[i] = append(t[i], b)
 	}
-	//authId := string(t[0])
-	authLogin := string(t[1])
-	authPasswd := t[2]
+	return names
+}
+
+// mechanismOffered checks if the mechanism can be used in the session, -PLUS variants need TLS
+// and EXTERNAL needs verified client certificate
+func (s *session) mechanismOffered(mech SASLMechanism) bool {
+	switch {
+	case strings.HasSuffix(mech.Name(), "-PLUS"):
+		return s.tls
+	case mech.Name() == "EXTERNAL":
+		return hasClientCertificate(s.peer)
+	}
+	return true
+}
+
+/*
+RFC 4616, The PLAIN Simple Authentication and Security Layer (SASL) Mechanism
+
+	message   = [authzid] UTF8NUL authcid UTF8NUL passwd
+*/
 
-	// check login
-	s.peer.Username = authLogin
-	ok, err := s.srv.Authenticator(s.peer, authPasswd)
+// PlainMechanism returns PLAIN mechanism checking passwords by f
+func PlainMechanism(f PasswordAuthenticator) SASLMechanism {
+	return &passwordMechanism{name: "PLAIN", authenticate: f}
+}
+
+// LoginMechanism returns the non-standard LOGIN mechanism checking passwords by f
+func LoginMechanism(f PasswordAuthenticator) SASLMechanism {
+	return &passwordMechanism{name: "LOGIN", authenticate: f}
+}
+
+// passwordMechanism implements PLAIN and LOGIN mechanisms
+type passwordMechanism struct {
+	name         string
+	authenticate PasswordAuthenticator
+}
+
+func (m *passwordMechanism) Name() string {
+	return m.name
+}
+
+func (m *passwordMechanism) Start(peer *Peer) SASLServer {
+	if m.name == "LOGIN" {
+		return &loginServer{mech: m, peer: peer}
+	}
+	return &plainServer{mech: m, peer: peer}
+}
+
+// check checks the password of peer.Username
+func (m *passwordMechanism) check(ctx context.Context, peer *Peer, password []byte) error {
+	ok, err := m.authenticate(ctx, peer, password)
 	if err != nil {
-		s.Out(Codes.ErrorAuth)
-		s.state = sessionStateAborted
-		return
+		return err
 	}
 	if !ok {
-		s.Out(Codes.FailAuthentication)
-		return
+		return ErrAuthFailed
 	}
-	// login succeeded
-	s.peer.Authenticated = true
-	s.Out(Codes.SuccessAuthentication)
-	return
+	return nil
+}
+
+type plainServer struct {
+	mech *passwordMechanism
+	peer *Peer
+}
+
+func (p *plainServer) Next(ctx context.Context, response []byte) ([]byte, bool, error) {
+	if response == nil {
+		// ask for the credentials with empty challenge
+		return []byte{}, false, nil
+	}
+	// authzid, authcid and passwd, the user acts as authzid if it's given
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, false, ErrAuthMalformed
+	}
+	p.peer.AuthorizationID = string(parts[0])
+	p.peer.Username = string(parts[1])
+	return nil, true, p.mech.check(ctx, p.peer, parts[2])
+}
+
+type loginServer struct {
+	mech     *passwordMechanism
+	peer     *Peer
+	username bool // username was received
+}
+
+func (l *loginServer) Next(ctx context.Context, response []byte) ([]byte, bool, error) {
+	switch {
+	case response == nil:
+		return []byte("Username:"), false, nil
+	case !l.username:
+		l.username = true
+		l.peer.Username = string(response)
+		return []byte("Password:"), false, nil
+	}
+	return nil, true, l.mech.check(ctx, l.peer, response)
 }
@@ -0,0 +1,230 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testAuthClient connects to TLS listener of the server and greets it
+func testAuthClient(t *testing.T, srv *Server) *smtp.Client {
+	srv.TLSConfig = testTLSConfig(t)
+	addr := startTestListener(t, srv, Listener{TLSMode: TLSImplicit})
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testAuthCmd sends authentication response and reads the reply
+func testAuthCmd(c *textproto.Conn, expectCode int, response string) (string, error) {
+	_, msg, err := testCmd(c, expectCode, response)
+	return msg, err
+}
+
+func TestServer_Auth(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	assert.Error(t, srv.Auth(nil, PlainMechanism(nil), PlainMechanism(nil)), "mechanism can't be registered twice")
+	assert.NoError(t, srv.Auth(func(peer *Peer, password []byte) (bool, error) {
+		return peer.Username == "user" && string(password) == "secret", nil
+	}))
+
+	c := testAuthClient(t, srv)
+	defer c.Close()
+	ok, mechs := c.Extension("AUTH")
+	assert.True(t, ok)
+	assert.Equal(t, "PLAIN LOGIN", mechs)
+
+	// cancelled exchange
+	_, err := testAuthCmd(c.Text, 334, "AUTH LOGIN")
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 501, "*")
+	assert.NoError(t, err)
+
+	// malformed response
+	_, err = testAuthCmd(c.Text, 501, "AUTH PLAIN not-base64!")
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 501, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret\x00")))
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 504, "AUTH UNKNOWN")
+	assert.NoError(t, err)
+
+	// LOGIN without initial response
+	msg, err := testAuthCmd(c.Text, 334, "AUTH LOGIN")
+	assert.NoError(t, err)
+	assert.Equal(t, "VXNlcm5hbWU6", msg)
+	_, err = testAuthCmd(c.Text, 334, base64.StdEncoding.EncodeToString([]byte("user")))
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 535, base64.StdEncoding.EncodeToString([]byte("wrong")))
+	assert.NoError(t, err)
+
+	// PLAIN with continuation
+	_, err = testAuthCmd(c.Text, 334, "AUTH PLAIN")
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 235, base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")))
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 503, "AUTH PLAIN")
+	assert.NoError(t, err, "AUTH is allowed only once")
+}
+
+func TestServer_AuthCRAMMD5(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	secret := CRAMMD5Secret([]byte("tanstaaftanstaaf"))
+	assert.NoError(t, srv.Auth(nil, CRAMMD5Mechanism(func(ctx context.Context, peer *Peer, username string) ([]byte, error) {
+		if username == "tim" {
+			return secret, nil
+		}
+		return nil, nil
+	})))
+
+	// RFC 2195 example
+	digest, err := cramDigest(secret, []byte("<1896.697170952@postoffice.reston.mci.net>"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b913a602c7eda7a495b4e6e7334d3890", hex.EncodeToString(digest))
+
+	c := testAuthClient(t, srv)
+	defer c.Close()
+	assert.Error(t, c.Auth(smtp.CRAMMD5Auth("tim", "wrong")))
+	c.Close()
+
+	c = testAuthClient(t, srv)
+	defer c.Close()
+	assert.NoError(t, c.Auth(smtp.CRAMMD5Auth("tim", "tanstaaftanstaaf")))
+}
+
+func TestServer_AuthAuthorizationID(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	srv.RecipientChecker = dummyChecker
+	assert.NoError(t, srv.Auth(func(peer *Peer, password []byte) (bool, error) {
+		return peer.Username == "user" && string(password) == "secret", nil
+	}))
+	envelopes := make(chan Envelope, 1)
+	srv.Handler = func(peer *Peer, env *Envelope) (string, error) {
+		assert.Equal(t, "user", peer.Username)
+		assert.Equal(t, "shared@localhost", peer.AuthorizationID)
+		envelopes <- *env
+		return "x", nil
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	c := testAuthClient(t, srv)
+	_, err := testAuthCmd(c.Text, 501, "AUTH PLAIN =")
+	assert.NoError(t, err, "empty response isn't valid PLAIN message")
+	_, err = testAuthCmd(c.Text, 535, "AUTH PLAIN "+b64("shared@localhost\x00user\x00secret"))
+	assert.NoError(t, err, "user can't act as other identity without Authorizer")
+	_, err = testAuthCmd(c.Text, 235, "AUTH PLAIN "+b64("user\x00user\x00secret"))
+	assert.NoError(t, err, "authzid of the user itself should be allowed")
+	c.Close()
+
+	srv.Authorizer = func(ctx context.Context, peer *Peer, authzid string) (bool, error) {
+		return peer.Username == "user" && authzid == "shared@localhost", nil
+	}
+	c = testAuthClient(t, srv)
+	defer c.Close()
+	_, err = testAuthCmd(c.Text, 535, "AUTH PLAIN "+b64("admin@localhost\x00user\x00secret"))
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 235, "AUTH PLAIN "+b64("shared@localhost\x00user\x00secret"))
+	assert.NoError(t, err)
+
+	_, _, err = testCmd(c.Text, 501, "MAIL FROM:<shared@localhost> AUTH=not-an-address")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c.Text, 250, "MAIL FROM:<shared@localhost> AUTH=e+3Dmc2@localhost")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Rcpt("recipient@localhost"))
+	w, err := c.Data()
+	assert.NoError(t, err)
+	w.Write([]byte("Subject: test\r\n\r\ntest\r\n"))
+	assert.NoError(t, w.Close())
+	env := <-envelopes
+	assert.Equal(t, "e=mc2@localhost", env.Auth, "AUTH parameter of authenticated client should be kept")
+}
+
+func TestServer_AuthFailureIdentity(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	assert.NoError(t, srv.Auth(func(peer *Peer, password []byte) (bool, error) {
+		return peer.Username == "user" && string(password) == "secret", nil
+	}))
+	srv.Authorizer = func(ctx context.Context, peer *Peer, authzid string) (bool, error) {
+		return false, nil
+	}
+	identities := make(chan [2]string, 1)
+	srv.RecipientChecker = func(peer *Peer, addr *mail.Address) error {
+		identities <- [2]string{peer.Username, peer.AuthorizationID}
+		return nil
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	c := testAuthClient(t, srv)
+	defer c.Close()
+	identity := func() [2]string {
+		_, _, err := testCmd(c.Text, 250, "MAIL FROM:<sender@localhost>")
+		assert.NoError(t, err)
+		_, _, err = testCmd(c.Text, 250, "RCPT TO:<recipient@localhost>")
+		assert.NoError(t, err)
+		_, _, err = testCmd(c.Text, 250, "RSET")
+		assert.NoError(t, err)
+		return <-identities
+	}
+
+	// identity which wasn't accepted isn't kept on the peer
+	_, err := testAuthCmd(c.Text, 535, "AUTH PLAIN "+b64("shared@localhost\x00user\x00wrong"))
+	assert.NoError(t, err)
+	assert.Equal(t, [2]string{}, identity(), "wrong password")
+	_, err = testAuthCmd(c.Text, 535, "AUTH PLAIN "+b64("shared@localhost\x00user\x00secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, [2]string{}, identity(), "authorization denied")
+	_, err = testAuthCmd(c.Text, 334, "AUTH LOGIN")
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 334, b64("user"))
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 501, "*")
+	assert.NoError(t, err)
+	assert.Equal(t, [2]string{}, identity(), "cancelled")
+
+	_, err = testAuthCmd(c.Text, 235, "AUTH PLAIN "+b64("\x00user\x00secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, [2]string{"user", ""}, identity())
+}
+
+func TestParseMailAuth(t *testing.T) {
+	mailbox, err := parseMailAuth("<>")
+	assert.NoError(t, err)
+	assert.Equal(t, "", mailbox)
+	mailbox, err = parseMailAuth("user+2Btag@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "user+tag@example.com", mailbox)
+	_, err = parseMailAuth("user=x@example.com")
+	assert.Error(t, err, "= has to be encoded")
+	mailbox, err = parseMailAuth(`"john+20doe"@[127.0.0.1]`)
+	assert.NoError(t, err)
+	assert.Equal(t, `"john doe"@[127.0.0.1]`, mailbox)
+	_, err = parseMailAuth("John+20<john@example.com>")
+	assert.Error(t, err, "RFC 5322 name-addr isn't RFC 5321 mailbox")
+	_, err = parseMailAuth("<john@example.com>")
+	assert.Error(t, err, "path isn't mailbox")
+}
@@ -0,0 +1,201 @@
+package gosmtp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthFailureLimit protects authentication from password guessing, failed attempts are counted
+// per client IP address and per user name, protection is disabled if MaxFailures is 0
+type AuthFailureLimit struct {
+	MaxFailures int           // failures after which the IP or user is locked out
+	Window      time.Duration // failures are forgotten after this time without another failure, a day if 0
+	Lockout     time.Duration // how long the IP or user is locked out, Window if 0, 15 minutes if both are 0
+	Delay       time.Duration // reply delay after the first failure, doubled with each next one
+	MaxDelay    time.Duration // maximum reply delay, unlimited if 0
+}
+
+const (
+	// maxAuthFailureAge is how long failures are kept if AuthFailureLimit.Window is 0
+	maxAuthFailureAge = 24 * time.Hour
+	// defaultAuthLockout is the lockout if neither AuthFailureLimit.Lockout nor Window is set
+	defaultAuthLockout = 15 * time.Minute
+)
+
+// authFailures is the failure count of one IP address or user
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// authGuard counts failed authentications of all the sessions of the server, see AuthFailureLimit
+type authGuard struct {
+	mu       sync.Mutex
+	failures map[string]*authFailures
+	calls    int
+	now      func() time.Time
+}
+
+// lockedUntil returns end of the lockout of the key, zero time if it's not locked out
+func (g *authGuard) lockedUntil(key string) time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.failures[key]; ok && g.time().Before(f.lockedUntil) {
+		return f.lockedUntil
+	}
+	return time.Time{}
+}
+
+// fail records failure of the key, returns the failure count and end of the lockout if the key got locked out
+func (g *authGuard) fail(key string, limit AuthFailureLimit) (int, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.time()
+	if g.failures == nil {
+		g.failures = make(map[string]*authFailures)
+	}
+	g.calls++
+	if g.calls%memoryStoreSweepEvery == 0 {
+		g.sweep(now, limit)
+	}
+
+	f, ok := g.failures[key]
+	if !ok || f.forgotten(now, limit) {
+		f = &authFailures{}
+		g.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count < limit.MaxFailures || now.Before(f.lockedUntil) {
+		return f.count, time.Time{}
+	}
+	lockout := limit.Lockout
+	if lockout <= 0 {
+		lockout = limit.Window
+	}
+	if lockout <= 0 {
+		lockout = defaultAuthLockout
+	}
+	f.lockedUntil = now.Add(lockout)
+	return f.count, f.lockedUntil
+}
+
+// reset forgets failures of the key which isn't locked out
+func (g *authGuard) reset(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.failures[key]; ok && !g.time().Before(f.lockedUntil) {
+		delete(g.failures, key)
+	}
+}
+
+// sweep removes the counts which are forgotten already
+func (g *authGuard) sweep(now time.Time, limit AuthFailureLimit) {
+	for key, f := range g.failures {
+		if f.forgotten(now, limit) {
+			delete(g.failures, key)
+		}
+	}
+}
+
+// forgotten checks if the window passed since the last failure and the key isn't locked out
+func (f *authFailures) forgotten(now time.Time, limit AuthFailureLimit) bool {
+	window := limit.Window
+	if window <= 0 {
+		window = maxAuthFailureAge
+	}
+	return now.Sub(f.last) > window && now.After(f.lockedUntil)
+}
+
+func (g *authGuard) time() time.Time {
+	if g.now != nil {
+		return g.now()
+	}
+	return time.Now()
+}
+
+// delay returns the reply delay after given number of failures
+func (limit AuthFailureLimit) delay(count int) time.Duration {
+	if limit.Delay <= 0 || count <= 0 {
+		return 0
+	}
+	delay := limit.Delay
+	for i := 1; i < count; i++ {
+		delay *= 2
+		if (limit.MaxDelay > 0 && delay >= limit.MaxDelay) || delay > time.Hour {
+			break
+		}
+	}
+	if limit.MaxDelay > 0 && delay > limit.MaxDelay {
+		delay = limit.MaxDelay
+	}
+	return delay
+}
+
+// authKeys returns keys of the failure counts of the session, the user is known once the client names it
+func (s *session) authKeys() []string {
+	var keys []string
+	if host, _ := splitHostPort(s.peer.Addr); net.ParseIP(host) != nil {
+		keys = append(keys, "ip:"+host)
+	}
+	if s.peer.Username != "" {
+		keys = append(keys, "user:"+strings.ToLower(s.peer.Username))
+	}
+	return keys
+}
+
+// authLockedOut checks if the client IP or the user is locked out and replies 454 if so
+func (s *session) authLockedOut() bool {
+	if s.listener.Limits.AuthFailures.MaxFailures <= 0 {
+		return false
+	}
+	for _, key := range s.authKeys() {
+		if !s.srv.authGuard.lockedUntil(key).IsZero() {
+			s.log.Printf("INFO: authentication of locked out %s refused", key)
+			s.Out(Codes.ErrorAuthLockout)
+			return true
+		}
+	}
+	return false
+}
+
+// authFailed counts failed authentication, locks the client IP or user out once they reach the limit
+// and delays the reply exponentially with the number of failures
+func (s *session) authFailed() {
+	limit := s.listener.Limits.AuthFailures
+	if limit.MaxFailures <= 0 {
+		return
+	}
+	var delay time.Duration
+	for _, key := range s.authKeys() {
+		count, until := s.srv.authGuard.fail(key, limit)
+		if d := limit.delay(count); d > delay {
+			delay = d
+		}
+		if !until.IsZero() {
+			s.log.Printf("INFO: %s locked out until %s after %d failed authentications", key, until.Format(time.RFC3339), count)
+			if s.srv.AuthLockout != nil {
+				s.srv.AuthLockout(s.peer, key, until)
+			}
+		}
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+// authSucceeded forgets failures of the client IP and the user
+func (s *session) authSucceeded() {
+	if s.listener.Limits.AuthFailures.MaxFailures <= 0 {
+		return
+	}
+	for _, key := range s.authKeys() {
+		s.srv.authGuard.reset(key)
+	}
+}
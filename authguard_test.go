@@ -0,0 +1,150 @@
+package gosmtp
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthFailureLimit_delay(t *testing.T) {
+	limit := AuthFailureLimit{Delay: time.Second, MaxDelay: 10 * time.Second}
+	assert.Equal(t, time.Duration(0), limit.delay(0))
+	assert.Equal(t, time.Second, limit.delay(1))
+	assert.Equal(t, 4*time.Second, limit.delay(3))
+	assert.Equal(t, 10*time.Second, limit.delay(5))
+	assert.Equal(t, 10*time.Second, limit.delay(1000))
+	assert.Equal(t, time.Duration(0), AuthFailureLimit{}.delay(3))
+}
+
+func TestAuthGuard(t *testing.T) {
+	now := time.Now()
+	g := &authGuard{now: func() time.Time { return now }}
+	limit := AuthFailureLimit{MaxFailures: 3, Window: time.Minute, Lockout: time.Hour}
+
+	count, until := g.fail("ip:192.0.2.1", limit)
+	assert.Equal(t, 1, count)
+	assert.True(t, until.IsZero())
+
+	// failures are forgotten after the window
+	now = now.Add(2 * time.Minute)
+	count, _ = g.fail("ip:192.0.2.1", limit)
+	assert.Equal(t, 1, count)
+	g.fail("ip:192.0.2.1", limit)
+	count, until = g.fail("ip:192.0.2.1", limit)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, now.Add(time.Hour), until)
+	assert.Equal(t, until, g.lockedUntil("ip:192.0.2.1"))
+	assert.True(t, g.lockedUntil("ip:192.0.2.2").IsZero())
+
+	// lockout can't be reset by success
+	g.reset("ip:192.0.2.1")
+	assert.Equal(t, until, g.lockedUntil("ip:192.0.2.1"))
+
+	now = now.Add(time.Hour + time.Second)
+	assert.True(t, g.lockedUntil("ip:192.0.2.1").IsZero())
+	count, until = g.fail("ip:192.0.2.1", limit)
+	assert.Equal(t, 1, count)
+	assert.True(t, until.IsZero())
+
+	// failures are kept for a day without the window
+	limit.Window = 0
+	g.fail("user:tim", limit)
+	g.fail("user:tim", limit)
+	now = now.Add(23 * time.Hour)
+	g.sweep(now, limit)
+	count, until = g.fail("user:tim", limit)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, now.Add(time.Hour), until)
+	g.fail("user:joe", limit)
+	now = now.Add(maxAuthFailureAge + time.Second)
+	g.sweep(now, limit)
+	assert.Len(t, g.failures, 0, "forgotten failures should be removed")
+
+	// lockout has a default length
+	limit.Lockout = 0
+	g.fail("user:tim", limit)
+	g.fail("user:tim", limit)
+	count, until = g.fail("user:tim", limit)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, now.Add(defaultAuthLockout), until)
+	assert.Equal(t, until, g.lockedUntil("user:tim"))
+}
+
+func TestServer_AuthLockout(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	srv.Limits.AuthFailures = AuthFailureLimit{MaxFailures: 3, Window: time.Minute, Delay: 10 * time.Millisecond}
+	assert.NoError(t, srv.Auth(func(peer *Peer, password []byte) (bool, error) {
+		return string(password) == "secret", nil
+	}))
+	var mu sync.Mutex
+	var locked []string
+	srv.AuthLockout = func(peer *Peer, key string, until time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		locked = append(locked, key)
+	}
+	plain := func(username, password string) string {
+		return "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00"+username+"\x00"+password))
+	}
+
+	c := testAuthClient(t, srv)
+	defer c.Close()
+	start := time.Now()
+	_, err := testAuthCmd(c.Text, 535, plain("user", "wrong"))
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 535, plain("user", "wrong"))
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond, "failures should be delayed exponentially")
+
+	// success forgets the failures
+	_, err = testAuthCmd(c.Text, 235, plain("user", "secret"))
+	assert.NoError(t, err)
+	c.Close()
+
+	c = testAuthClient(t, srv)
+	for i := 0; i < 2; i++ {
+		_, err = testAuthCmd(c.Text, 535, plain("user", "wrong"))
+		assert.NoError(t, err)
+	}
+	mu.Lock()
+	assert.Empty(t, locked)
+	mu.Unlock()
+	_, err = testAuthCmd(c.Text, 535, plain("user", "wrong"))
+	assert.NoError(t, err)
+	mu.Lock()
+	assert.ElementsMatch(t, []string{"ip:127.0.0.1", "user:user"}, locked)
+	mu.Unlock()
+
+	_, err = testAuthCmd(c.Text, 454, plain("user", "secret"))
+	assert.NoError(t, err, "locked out client can't authenticate even with right password")
+	c.Close()
+}
+
+func TestServer_AuthLockoutCancel(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	srv.Limits.AuthFailures = AuthFailureLimit{MaxFailures: 2, Window: time.Minute}
+	assert.NoError(t, srv.Auth(nil, OAuthBearerMechanism(func(ctx context.Context, peer *Peer, token string) (bool, error) {
+		return token == "valid", nil
+	})))
+	bearer := "AUTH OAUTHBEARER " + base64.StdEncoding.EncodeToString([]byte("n,,\x01auth=Bearer guess\x01\x01"))
+
+	c := testAuthClient(t, srv)
+	defer c.Close()
+	// cancelling after the error challenge still counts the rejected token
+	for i := 0; i < 2; i++ {
+		_, err := testAuthCmd(c.Text, 334, bearer)
+		assert.NoError(t, err)
+		_, err = testAuthCmd(c.Text, 501, "*")
+		assert.NoError(t, err)
+	}
+	_, err := testAuthCmd(c.Text, 454, bearer)
+	assert.NoError(t, err)
+}
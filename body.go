@@ -0,0 +1,302 @@
+package gosmtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+RFC 6152, SMTP Service Extension for 8-bit MIME Transport
+
+	body-value ::= "7BIT" / "8BITMIME"
+
+	If the BODY parameter is not given, the message is 7-bit, i.e. it contains
+	only US-ASCII characters. The server relaying 8-bit message to a server without
+	8BITMIME support has to convert the message to 7-bit MIME, or return it as
+	undeliverable.
+
+RFC 3030 adds "BINARYMIME" body-value, such message can be sent with BDAT only.
+*/
+
+// BodyType is the BODY parameter of MAIL command
+type BodyType string
+
+const (
+	// BodyType7Bit - the message contains only 7-bit US-ASCII data
+	BodyType7Bit BodyType = "7BIT"
+	// BodyType8BitMIME - the message may contain 8-bit data in lines up to 998 octets
+	BodyType8BitMIME BodyType = "8BITMIME"
+	// BodyTypeBinaryMIME - the message may contain binary MIME parts
+	BodyTypeBinaryMIME BodyType = "BINARYMIME"
+)
+
+// parseBodyType parses value of the BODY parameter
+func parseBodyType(value string) (BodyType, error) {
+	switch body := BodyType(strings.ToUpper(value)); body {
+	case BodyType7Bit, BodyType8BitMIME, BodyTypeBinaryMIME:
+		return body, nil
+	}
+	return "", errors.New("invalid BODY parameter")
+}
+
+// Is7Bit returns if the body is 7-bit, which is the default if the BODY parameter wasn't given
+func (t BodyType) Is7Bit() bool {
+	return t == "" || t == BodyType7Bit
+}
+
+// EightBitPolicy sets how 8-bit data in message declared as 7-bit are handled
+type EightBitPolicy int
+
+const (
+	// EightBitAccept - the message is accepted and flagged by Envelope.EightBit
+	EightBitAccept EightBitPolicy = iota
+	// EightBitReject - the message is read till the end and rejected
+	EightBitReject
+)
+
+// errEightBitData is returned to StreamHandler when the message is rejected for 8-bit data
+var errEightBitData = errors.New("8-bit data in 7-bit message")
+
+// Err8BitHeader is returned by ConvertTo7Bit if a header contains 8-bit data, which can't be converted
+var Err8BitHeader = errors.New("8-bit data in message header can't be converted")
+
+// eightBitWriter passes message data to w and records if they contain 8-bit octets
+type eightBitWriter struct {
+	w        io.Writer
+	eightBit bool
+}
+
+func (ew *eightBitWriter) Write(p []byte) (int, error) {
+	if !ew.eightBit && has8Bit(p) {
+		ew.eightBit = true
+	}
+	return ew.w.Write(p)
+}
+
+// has8Bit checks if data contain octets over 127
+func has8Bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// ConvertTo7Bit converts the message read from r into 7-bit MIME and writes it to w
+// it's meant for relaying 8BITMIME or BINARYMIME message to server without their support.
+// MIME parts with 8-bit data are re-encoded, text parts to quoted-printable, others to base64,
+// multipart and message/rfc822 parts are converted recursively. Headers with 8-bit data can't
+// be converted, Err8BitHeader is returned for them. 7-bit parts are kept as they are.
+func ConvertTo7Bit(w io.Writer, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	data, err = convertEntity(data, "text/plain", true)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		data = append(data, "\r\n"...)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// convertEntity converts the message or body part, defaultType is used if it has no Content-Type,
+// message without MIME-Version gets MIME headers, so the receiver decodes its new encoding
+func convertEntity(entity []byte, defaultType string, message bool) ([]byte, error) {
+	if !has8Bit(entity) {
+		return entity, nil
+	}
+	header, body := splitEntity(entity)
+	if has8Bit(header) {
+		return nil, Err8BitHeader
+	}
+	fields, err := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(header), strings.NewReader("\r\n")))).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// invalid Content-Type is treated as text/plain
+	contentType := fields.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultType
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	var cte string
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		partType := "text/plain"
+		if mediaType == "multipart/digest" {
+			partType = "message/rfc822"
+		}
+		if body, err = convertMultipart(body, params["boundary"], partType); err != nil {
+			return nil, err
+		}
+		cte = "7bit"
+	case mediaType == "message/rfc822":
+		if body, err = convertEntity(body, "text/plain", true); err != nil {
+			return nil, err
+		}
+		cte = "7bit"
+	default:
+		switch strings.ToLower(strings.TrimSpace(fields.Get("Content-Transfer-Encoding"))) {
+		case "", "7bit", "8bit", "binary":
+		default:
+			// already encoded, the 8-bit data are invalid but there's nothing to convert
+			return entity, nil
+		}
+		if strings.HasPrefix(mediaType, "text/") {
+			body, cte = encodeQuotedPrintable(body), "quoted-printable"
+		} else {
+			body, cte = encodeBase64(body), "base64"
+		}
+	}
+
+	out := replaceTransferEncoding(header, cte)
+	if message && fields.Get("MIME-Version") == "" {
+		out = append(out, "MIME-Version: 1.0\r\n"...)
+		if fields.Get("Content-Type") == "" {
+			// non-MIME message is text in charset which is unknown unless it's valid UTF-8, RFC 1428
+			charset := "unknown-8bit"
+			if _, text := splitEntity(entity); utf8.Valid(text) {
+				charset = "utf-8"
+			}
+			out = append(out, "Content-Type: text/plain; charset="+charset+"\r\n"...)
+		}
+	}
+	out = append(out, "\r\n"...)
+	return append(out, body...), nil
+}
+
+// splitEntity splits MIME entity into header, including the last line break, and body after the empty line
+func splitEntity(entity []byte) ([]byte, []byte) {
+	for i := 0; i < len(entity); {
+		j := bytes.IndexByte(entity[i:], '\n')
+		if j < 0 {
+			break
+		}
+		if len(bytes.TrimRight(entity[i:i+j+1], "\r\n")) == 0 {
+			return entity[:i], entity[i+j+1:]
+		}
+		i += j + 1
+	}
+	return entity, nil
+}
+
+// convertMultipart converts body parts of multipart body, preamble and epilogue are kept as they are
+func convertMultipart(body []byte, boundary, partType string) ([]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart without boundary")
+	}
+	delimiter := []byte("--" + boundary)
+	var out []byte
+	start, inPart := 0, false
+	for i := 0; i < len(body); {
+		end := len(body)
+		if j := bytes.IndexByte(body[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+		line := body[i:end]
+		if !bytes.HasPrefix(line, delimiter) {
+			i = end
+			continue
+		}
+		rest := string(bytes.TrimRight(line[len(delimiter):], " \t\r\n"))
+		closing := rest == "--"
+		if rest != "" && !closing {
+			i = end
+			continue
+		}
+
+		// the line break before delimiter belongs to the delimiter
+		cut := i
+		if cut > start && body[cut-1] == '\n' {
+			cut--
+			if cut > start && body[cut-1] == '\r' {
+				cut--
+			}
+		}
+		if inPart {
+			part, err := convertEntity(body[start:cut], partType, false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, part...)
+		} else {
+			out = append(out, body[start:cut]...)
+		}
+		out = append(out, body[cut:end]...)
+		start, inPart = end, !closing
+		if closing {
+			break
+		}
+		i = end
+	}
+	if inPart {
+		// missing closing delimiter, the rest is the last part
+		part, err := convertEntity(body[start:], partType, false)
+		if err != nil {
+			return nil, err
+		}
+		return append(out, part...), nil
+	}
+	return append(out, body[start:]...), nil
+}
+
+// replaceTransferEncoding returns the header with Content-Transfer-Encoding field set to cte
+func replaceTransferEncoding(header []byte, cte string) []byte {
+	var out []byte
+	skip := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skip = strings.EqualFold(string(bytes.TrimSpace(name)), "Content-Transfer-Encoding")
+		}
+		if !skip {
+			out = append(out, line...)
+		}
+	}
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, "\r\n"...)
+	}
+	return append(out, "Content-Transfer-Encoding: "+cte+"\r\n"...)
+}
+
+// encodeQuotedPrintable encodes text body, line breaks are kept as CRLF
+func encodeQuotedPrintable(body []byte) []byte {
+	var buf bytes.Buffer
+	qw := quotedprintable.NewWriter(&buf)
+	qw.Write(body)
+	qw.Close()
+	return buf.Bytes()
+}
+
+// encodeBase64 encodes body into lines of 76 characters, without line break at the end
+func encodeBase64(body []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(body)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	return buf.Bytes()
+}
@@ -0,0 +1,165 @@
+package gosmtp
+
+import (
+	"bytes"
+	"log"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBodyType(t *testing.T) {
+	for value, expected := range map[string]BodyType{
+		"7BIT":       BodyType7Bit,
+		"8bitmime":   BodyType8BitMIME,
+		"BinaryMIME": BodyTypeBinaryMIME,
+		"8BIT":       "",
+		"":           "",
+	} {
+		body, err := parseBodyType(value)
+		assert.Equal(t, expected, body, value)
+		assert.Equal(t, expected == "", err != nil, value)
+	}
+	assert.True(t, BodyType("").Is7Bit())
+	assert.False(t, BodyType8BitMIME.Is7Bit())
+}
+
+func TestConvertTo7Bit(t *testing.T) {
+	msg := "From: sender@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"Příliš žluťoučký kůň\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"\r\n" +
+		"\xff\xfe\x00\x01\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"plain ascii\r\n" +
+		"--b1--\r\n" +
+		"epilogue\r\n"
+
+	var buf bytes.Buffer
+	assert.NoError(t, ConvertTo7Bit(&buf, strings.NewReader(msg)))
+	assert.False(t, has8Bit(buf.Bytes()))
+	assert.Equal(t, "From: sender@example.com\r\n"+
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n"+
+		"Content-Transfer-Encoding: 7bit\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"\r\n"+
+		"preamble\r\n"+
+		"--b1\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"P=C5=99=C3=ADli=C5=A1 =C5=BElu=C5=A5ou=C4=8Dk=C3=BD k=C5=AF=C5=88\r\n"+
+		"--b1\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		"//4AAQ==\r\n"+
+		"--b1\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"plain ascii\r\n"+
+		"--b1--\r\n"+
+		"epilogue\r\n", buf.String())
+
+	// non-MIME message gets MIME headers, so the receiver decodes the body
+	buf.Reset()
+	assert.NoError(t, ConvertTo7Bit(&buf, strings.NewReader("Subject: test\r\n\r\nžluťoučký kůň\r\n")))
+	assert.Equal(t, "Subject: test\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"=C5=BElu=C5=A5ou=C4=8Dk=C3=BD k=C5=AF=C5=88\r\n", buf.String())
+	buf.Reset()
+	assert.NoError(t, ConvertTo7Bit(&buf, strings.NewReader("Subject: test\r\n\r\n\xe8au\r\n")))
+	assert.Contains(t, buf.String(), "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=unknown-8bit\r\n\r\n=E8au\r\n")
+
+	// MIME message keeps its headers
+	buf.Reset()
+	assert.NoError(t, ConvertTo7Bit(&buf, strings.NewReader("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=iso-8859-2\r\n\r\n\xe8au\r\n")))
+	assert.Equal(t, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=iso-8859-2\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n=E8au\r\n", buf.String())
+
+	// 7-bit message is not changed
+	buf.Reset()
+	assert.NoError(t, ConvertTo7Bit(&buf, strings.NewReader("Subject: test\r\n\r\nhello\r\n")))
+	assert.Equal(t, "Subject: test\r\n\r\nhello\r\n", buf.String())
+
+	// encoded words are needed for 8-bit headers
+	assert.Equal(t, Err8BitHeader, ConvertTo7Bit(&buf, strings.NewReader("Subject: ünïcödé\r\n\r\nhello\r\n")))
+}
+
+func TestSession_BodyType(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	envs := make(chan *Envelope, 1)
+	srv.Handler = func(peer *Peer, env *Envelope) (string, error) {
+		envs <- &Envelope{BodyType: env.BodyType, EightBit: env.EightBit}
+		return "", nil
+	}
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+
+	_, _, err = testCmd(c, 501, "MAIL FROM:<sender@[127.0.0.1]> BODY=8BIT")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@[127.0.0.1]> BODY=8bitmime")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RCPT TO:<rcpt@[127.0.0.1]>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "Subject: test\r\n\r\nžluťoučký kůň\r\n.")
+	assert.NoError(t, err)
+	env := <-envs
+	assert.Equal(t, BodyType8BitMIME, env.BodyType)
+	assert.True(t, env.EightBit)
+
+	// 8-bit data in 7-bit message are flagged by default
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@[127.0.0.1]>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RCPT TO:<rcpt@[127.0.0.1]>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "Subject: test\r\n\r\nžluťoučký kůň\r\n.")
+	assert.NoError(t, err)
+	env = <-envs
+	assert.True(t, env.BodyType.Is7Bit())
+	assert.True(t, env.EightBit)
+
+	// or rejected
+	srv.EightBitData = EightBitReject
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@[127.0.0.1]> BODY=7BIT")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RCPT TO:<rcpt@[127.0.0.1]>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 554, "Subject: test\r\n\r\nžluťoučký kůň\r\n.")
+	assert.NoError(t, err)
+
+	// BINARYMIME can't be sent with DATA
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@[127.0.0.1]> BODY=BINARYMIME")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RCPT TO:<rcpt@[127.0.0.1]>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 503, "DATA")
+	assert.NoError(t, err)
+}
@@ -27,6 +27,9 @@ const (
 	helpCmd
 	authCmd
 	bdatCmd
+	xclientCmd
+	xforwardCmd
+	lhloCmd
 )
 
 /*
@@ -90,6 +93,12 @@ func parseCommand(line string) (*command, error) {
 		cmdCode = authCmd
 	case "BDAT":
 		cmdCode = bdatCmd
+	case "XCLIENT":
+		cmdCode = xclientCmd
+	case "XFORWARD":
+		cmdCode = xforwardCmd
+	case "LHLO":
+		cmdCode = lhloCmd
 	default:
 		return nil, errors.New("unrecognized command")
 	}
@@ -116,6 +125,11 @@ func parseCommand(line string) (*command, error) {
 	return cmd, nil
 }
 
+// argument returns the command line without the verb
+func (cmd *command) argument() string {
+	return strings.TrimLeft(cmd.data[len(cmd.verb):], " ")
+}
+
 /*
 String returns back the original line with command as a string
 */
@@ -0,0 +1,128 @@
+package gosmtp
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	defaultSubnetPrefixIPv4 = 24
+	defaultSubnetPrefixIPv6 = 64
+)
+
+// ConnectionStats holds current number of concurrent sessions, for monitoring purposes
+type ConnectionStats struct {
+	Total     int            // all sessions
+	PerIP     map[string]int // sessions per client IP address
+	PerSubnet map[string]int // sessions per client subnet, e.g. 192.0.2.0/24
+}
+
+// connCounter counts concurrent sessions in total, per IP and per subnet
+type connCounter struct {
+	mu        sync.Mutex
+	total     int
+	perIP     map[string]int
+	perSubnet map[string]int
+}
+
+// subnetKey returns subnet of the IP address given the prefix lengths from limits
+func subnetKey(ip net.IP, limits *Limits) string {
+	bits, prefix := 8*net.IPv6len, limits.SubnetPrefixIPv6
+	if prefix == 0 {
+		prefix = defaultSubnetPrefixIPv6
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 8*net.IPv4len, limits.SubnetPrefixIPv4
+		if prefix == 0 {
+			prefix = defaultSubnetPrefixIPv4
+		}
+	}
+	subnet := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return subnet.String()
+}
+
+// acquire adds session from given IP address (nil if the address is not IP) to the counts
+// returns false if any of the limits would be exceeded, the session is not counted in such case
+func (c *connCounter) acquire(ip net.IP, limits *Limits) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perIP == nil {
+		c.perIP = make(map[string]int)
+		c.perSubnet = make(map[string]int)
+	}
+	if limits.MaxConnections > 0 && c.total >= limits.MaxConnections {
+		return false
+	}
+	if ip == nil {
+		c.total++
+		return true
+	}
+	ipKey, subnet := ip.String(), subnetKey(ip, limits)
+	if limits.MaxConnectionsPerIP > 0 && c.perIP[ipKey] >= limits.MaxConnectionsPerIP {
+		return false
+	}
+	if limits.MaxConnectionsPerSubnet > 0 && c.perSubnet[subnet] >= limits.MaxConnectionsPerSubnet {
+		return false
+	}
+	c.total++
+	c.perIP[ipKey]++
+	c.perSubnet[subnet]++
+	return true
+}
+
+// acquireIP adds IP address to the counts of session acquired without it, e.g. before the PROXY header
+// was read, returns false if per IP or per subnet limit would be exceeded, the IP is not counted in such case
+func (c *connCounter) acquireIP(ip net.IP, limits *Limits) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ipKey, subnet := ip.String(), subnetKey(ip, limits)
+	if limits.MaxConnectionsPerIP > 0 && c.perIP[ipKey] >= limits.MaxConnectionsPerIP {
+		return false
+	}
+	if limits.MaxConnectionsPerSubnet > 0 && c.perSubnet[subnet] >= limits.MaxConnectionsPerSubnet {
+		return false
+	}
+	c.perIP[ipKey]++
+	c.perSubnet[subnet]++
+	return true
+}
+
+// release removes session previously counted by acquire
+func (c *connCounter) release(ip net.IP, limits *Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total--
+	if ip == nil {
+		return
+	}
+	ipKey, subnet := ip.String(), subnetKey(ip, limits)
+	if c.perIP[ipKey]--; c.perIP[ipKey] <= 0 {
+		delete(c.perIP, ipKey)
+	}
+	if c.perSubnet[subnet]--; c.perSubnet[subnet] <= 0 {
+		delete(c.perSubnet, subnet)
+	}
+}
+
+// stats returns copy of the current counts
+func (c *connCounter) stats() ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := ConnectionStats{
+		Total:     c.total,
+		PerIP:     make(map[string]int, len(c.perIP)),
+		PerSubnet: make(map[string]int, len(c.perSubnet)),
+	}
+	for k, v := range c.perIP {
+		stats.PerIP[k] = v
+	}
+	for k, v := range c.perSubnet {
+		stats.PerSubnet[k] = v
+	}
+	return stats
+}
+
+// ConnectionStats returns current number of concurrent sessions in total, per IP and per subnet
+func (srv *Server) ConnectionStats() ConnectionStats {
+	return srv.conns.stats()
+}
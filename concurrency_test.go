@@ -0,0 +1,117 @@
+package gosmtp
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnCounter(t *testing.T) {
+	var c connCounter
+	limits := &Limits{MaxConnections: 4, MaxConnectionsPerIP: 2, MaxConnectionsPerSubnet: 3}
+
+	assert.True(t, c.acquire(net.ParseIP("192.0.2.1"), limits))
+	assert.True(t, c.acquire(net.ParseIP("192.0.2.1"), limits))
+	assert.False(t, c.acquire(net.ParseIP("192.0.2.1"), limits), "per IP limit should be reached")
+	assert.True(t, c.acquire(net.ParseIP("192.0.2.2"), limits))
+	assert.False(t, c.acquire(net.ParseIP("192.0.2.3"), limits), "per subnet limit should be reached")
+	assert.True(t, c.acquire(net.ParseIP("2001:db8::1"), limits))
+	assert.False(t, c.acquire(net.ParseIP("2001:db8:1::1"), limits), "total limit should be reached")
+
+	stats := c.stats()
+	assert.Equal(t, 4, stats.Total)
+	assert.Equal(t, 2, stats.PerIP["192.0.2.1"])
+	assert.Equal(t, 3, stats.PerSubnet["192.0.2.0/24"])
+	assert.Equal(t, 1, stats.PerSubnet["2001:db8::/64"])
+
+	c.release(net.ParseIP("192.0.2.1"), limits)
+	c.release(net.ParseIP("192.0.2.2"), limits)
+	c.release(net.ParseIP("2001:db8::1"), limits)
+	assert.True(t, c.acquire(net.ParseIP("192.0.2.3"), limits))
+
+	stats = c.stats()
+	assert.Equal(t, 2, stats.Total)
+	assert.Equal(t, map[string]int{"192.0.2.1": 1, "192.0.2.3": 1}, stats.PerIP)
+	assert.Equal(t, map[string]int{"192.0.2.0/24": 2}, stats.PerSubnet)
+}
+
+func TestSubnetKey(t *testing.T) {
+	assert.Equal(t, "192.0.2.0/24", subnetKey(net.ParseIP("192.0.2.77"), &Limits{}))
+	assert.Equal(t, "192.0.0.0/16", subnetKey(net.ParseIP("192.0.2.77"), &Limits{SubnetPrefixIPv4: 16}))
+	assert.Equal(t, "2001:db8:0:1::/64", subnetKey(net.ParseIP("2001:db8:0:1::5"), &Limits{}))
+	assert.Equal(t, "2001:db8::/48", subnetKey(net.ParseIP("2001:db8:0:1::5"), &Limits{SubnetPrefixIPv6: 48}))
+}
+
+func TestServer_ConnectionLimits(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Handler = dummyHandle
+	srv.Limits.MaxConnectionsPerIP = 1
+	defer srv.Close()
+	addr := startTestListener(t, srv, Listener{})
+
+	first, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, _, err = first.ReadResponse(220)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, srv.ConnectionStats().PerIP["127.0.0.1"])
+
+	second, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, _, err = second.ReadResponse(220)
+	assert.Error(t, err, "second connection from the same IP should be rejected")
+	assert.Contains(t, err.Error(), "421")
+	second.Close()
+
+	_, _, err = testCmd(first, 221, "QUIT")
+	assert.NoError(t, err)
+	first.Close()
+
+	third, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, _, err = third.ReadResponse(220)
+	assert.NoError(t, err, "connection should be accepted after the previous one ended")
+	third.Close()
+}
+
+func TestServer_ConnectionLimitsIdleClient(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.TLSConfig = testTLSConfig(t)
+	srv.Limits.MaxConnectionsPerIP = 1
+	defer srv.Close()
+	waitTotal := func(total int) bool {
+		for i := 0; i < 100; i++ {
+			if srv.ConnectionStats().Total == total {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	// client which never starts TLS handshake holds the slot
+	addr := startTestListener(t, srv, Listener{TLSMode: TLSImplicit})
+	idle, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	assert.True(t, waitTotal(1), "idle client should be counted before the handshake")
+	assert.Equal(t, 1, srv.ConnectionStats().PerIP["127.0.0.1"])
+	_, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.Error(t, err, "connection over the limit should be closed without handshake")
+	idle.Close()
+	assert.True(t, waitTotal(0), "slot should be released when idle client disconnects")
+
+	// client behind proxy is counted in total until it sends the PROXY header
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	addr = startTestListener(t, srv, Listener{ProxyProtocol: true, TrustedProxies: []*net.IPNet{loopback}})
+	idle, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	assert.True(t, waitTotal(1), "idle client should be counted before the PROXY header")
+	assert.Empty(t, srv.ConnectionStats().PerIP)
+	idle.Close()
+	assert.True(t, waitTotal(0))
+}
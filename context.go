@@ -0,0 +1,142 @@
+package gosmtp
+
+import (
+	"context"
+	"net/mail"
+	"time"
+)
+
+// contextKey is type of the keys of values stored in session context
+type contextKey int
+
+const (
+	sessionIDContextKey contextKey = iota
+	peerContextKey
+)
+
+// SessionID returns ID of the session from context passed to hooks, empty if there is none
+func SessionID(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDContextKey).(string)
+	return id
+}
+
+// PeerFromContext returns peer of the session from context passed to hooks, nil if there is none
+func PeerFromContext(ctx context.Context) *Peer {
+	peer, _ := ctx.Value(peerContextKey).(*Peer)
+	return peer
+}
+
+// newSessionContext returns context of the session lifetime carrying the session ID and peer
+func newSessionContext(parent context.Context, id string, peer *Peer) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(parent, sessionIDContextKey, id)
+	ctx = context.WithValue(ctx, peerContextKey, peer)
+	return context.WithCancel(ctx)
+}
+
+// hookContext returns context for single hook call limited by timeout (none if 0)
+// the context is canceled if the client disconnects while the hook is running
+// returned function releases the context and must be called before reading from the client again
+func (s *session) hookContext(timeout time.Duration) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
+	}
+	stop := s.watchDisconnect(cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// watchDisconnect calls cancel once the client closes the connection
+// it waits for input in background, which is left buffered for the session, until the returned function is called
+func (s *session) watchDisconnect(cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := s.bufio.Peek(1)
+		if err != nil && !isTimeout(err) {
+			cancel()
+		}
+	}()
+	return func() {
+		// interrupt the waiting, the timeout error is not kept by the reader
+		s.conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		s.conn.SetReadDeadline(s.readDeadline)
+	}
+}
+
+// checkConnection calls the connection checker of the listener
+func (s *session) checkConnection() error {
+	if s.listener.ConnectionCheckerContext == nil {
+		return nil
+	}
+	ctx, done := s.hookContext(s.listener.Limits.CmdInput)
+	defer done()
+	return s.listener.ConnectionCheckerContext(ctx, s.peer)
+}
+
+// checkHelo calls the HELO/EHLO checker of the listener
+func (s *session) checkHelo(name string) error {
+	if s.listener.HeloCheckerContext == nil {
+		return nil
+	}
+	ctx, done := s.hookContext(s.listener.Limits.CmdInput)
+	defer done()
+	return s.listener.HeloCheckerContext(ctx, s.peer, name)
+}
+
+// checkSender calls the sender checker of the listener
+func (s *session) checkSender(addr *mail.Address) error {
+	if s.listener.SenderCheckerContext == nil {
+		return nil
+	}
+	ctx, done := s.hookContext(s.listener.Limits.CmdInput)
+	defer done()
+	return s.listener.SenderCheckerContext(ctx, s.peer, addr)
+}
+
+// checkRecipient calls the recipient checker of the listener
+func (s *session) checkRecipient(addr *mail.Address) error {
+	if s.listener.RecipientCheckerContext == nil {
+		return nil
+	}
+	ctx, done := s.hookContext(s.listener.Limits.CmdInput)
+	defer done()
+	return s.listener.RecipientCheckerContext(ctx, s.peer, addr)
+}
+
+// authenticate calls the server authenticator with the password of peer.Username, used by PLAIN and LOGIN
+func (srv *Server) authenticate(ctx context.Context, peer *Peer, password []byte) (bool, error) {
+	if srv.AuthenticatorContext != nil {
+		return srv.AuthenticatorContext(ctx, peer, password)
+	}
+	if srv.Authenticator != nil {
+		return srv.Authenticator(peer, password)
+	}
+	return false, nil
+}
+
+// handle hands the received message off to the server handler, the message is accepted if there is none
+func (s *session) handle() (string, error) {
+	ctx, done := s.hookContext(s.listener.Limits.MsgInput)
+	defer done()
+	if s.srv.HandlerContext != nil {
+		return s.srv.HandlerContext(ctx, s.peer, s.envelope)
+	}
+	if s.srv.Handler != nil {
+		return s.srv.Handler(s.peer, s.envelope)
+	}
+	return "", nil
+}
+
+// handleRecipients hands the received message off to the server recipient handler
+func (s *session) handleRecipients() (string, []error) {
+	ctx, done := s.hookContext(s.listener.Limits.MsgInput)
+	defer done()
+	return s.srv.RecipientHandler(ctx, s.peer, s.envelope)
+}
@@ -0,0 +1,138 @@
+package gosmtp
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_HookContext(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Hostname = "test.com"
+	srv.Limits.CmdInput = time.Second
+
+	type hookCall struct {
+		id   string
+		peer *Peer
+		err  error
+	}
+	sender, rcpt, handler := make(chan hookCall, 1), make(chan hookCall, 1), make(chan hookCall, 1)
+	srv.SenderCheckerContext = func(ctx context.Context, peer *Peer, addr *mail.Address) error {
+		sender <- hookCall{id: SessionID(ctx), peer: PeerFromContext(ctx)}
+		return nil
+	}
+	srv.RecipientCheckerContext = func(ctx context.Context, peer *Peer, addr *mail.Address) error {
+		<-ctx.Done()
+		rcpt <- hookCall{err: ctx.Err()}
+		return ctx.Err()
+	}
+	srv.HandlerContext = func(ctx context.Context, peer *Peer, env *Envelope) (string, error) {
+		<-ctx.Done()
+		handler <- hookCall{err: ctx.Err()}
+		return "", ctx.Err()
+	}
+
+	conn := testDial(srv)
+	c := textproto.NewConn(conn)
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+
+	// context carries the session information
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@localhost>")
+	assert.NoError(t, err)
+	call := <-sender
+	assert.NotEmpty(t, call.id)
+	if assert.NotNil(t, call.peer) {
+		assert.Equal(t, "localhost", call.peer.HeloName)
+	}
+
+	// checkers are limited by CmdInput
+	_, _, err = testCmd(c, 554, "RCPT TO:<slow@localhost>")
+	assert.NoError(t, err)
+	assert.Equal(t, context.DeadlineExceeded, (<-rcpt).err)
+
+	// the handler is canceled once the client goes away
+	srv.RecipientCheckerContext = nil
+	c2 := textproto.NewConn(testDial(srv))
+	_, _, err = c2.ReadResponse(220)
+	assert.NoError(t, err)
+	for _, cmd := range []string{"EHLO localhost", "MAIL FROM:<sender@localhost>", "RCPT TO:<rcpt@localhost>"} {
+		_, _, err = testCmd(c2, 250, cmd)
+		assert.NoError(t, err)
+	}
+	_, _, err = testCmd(c2, 354, "DATA")
+	assert.NoError(t, err)
+	assert.NoError(t, c2.PrintfLine("Subject: test\r\n\r\nHello\r\n."))
+	time.Sleep(50 * time.Millisecond)
+	c2.Close()
+	select {
+	case call := <-handler:
+		assert.Equal(t, context.Canceled, call.err)
+	case <-time.After(time.Second):
+		t.Error("handler context wasn't canceled after disconnect")
+	}
+	c.Close()
+}
+
+func TestSession_watchDisconnectDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := &session{conn: server, bufio: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+	s.setReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	stop := s.watchDisconnect(func() {})
+	stop()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.ReadLine()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.True(t, isTimeout(err), "read deadline set before the hook should be kept")
+	case <-time.After(time.Second):
+		t.Error("read deadline was wiped by watchDisconnect")
+		server.Close()
+	}
+}
+
+func TestListener_resolveCheckers(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	called := ""
+	srv.HeloChecker = func(peer *Peer, name string) error {
+		called = "server " + name
+		return nil
+	}
+	srv.SenderCheckerContext = func(ctx context.Context, peer *Peer, addr *mail.Address) error {
+		called = "server context " + addr.Address
+		return nil
+	}
+
+	l := srv.resolveListener(&Listener{
+		SenderChecker: func(peer *Peer, addr *mail.Address) error {
+			called = "listener " + addr.Address
+			return nil
+		},
+	})
+	assert.Nil(t, l.ConnectionCheckerContext)
+	assert.Nil(t, l.RecipientCheckerContext)
+
+	l.HeloCheckerContext(context.Background(), &Peer{}, "localhost")
+	assert.Equal(t, "server localhost", called, "plain server checker should be used")
+	l.SenderCheckerContext(context.Background(), &Peer{}, &mail.Address{Address: "a@localhost"})
+	assert.Equal(t, "listener a@localhost", called, "listener checker should have priority")
+
+	l = srv.resolveListener(&Listener{})
+	l.SenderCheckerContext(context.Background(), &Peer{}, &mail.Address{Address: "a@localhost"})
+	assert.Equal(t, "server context a@localhost", called, "context server checker should be used")
+}
@@ -0,0 +1,143 @@
+package gosmtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+/*
+RFC 2195, IMAP/POP AUTHorize Extension for Simple Challenge/Response
+
+	The data encoded in the first ready response contains an
+	presumptively arbitrary string of random digits, a timestamp, and the
+	fully-qualified primary host name of the server.
+
+	The client makes note of the data and then responds with a string
+	consisting of the user name, a space, and a 'digest'.  The latter is
+	computed by applying the keyed MD5 algorithm from [KEYED-MD5] where
+	the key is a shared secret and the digested text is the timestamp
+	(including angle-brackets).
+
+The server doesn't need the password, HMAC-MD5 can be computed from MD5 states after the inner
+and outer padded key, which are stored instead, see CRAMMD5Secret.
+*/
+
+// CRAMMD5Lookup returns the secret of the user made by CRAMMD5Secret, nil if the user doesn't exist
+type CRAMMD5Lookup func(ctx context.Context, peer *Peer, username string) ([]byte, error)
+
+// CRAMMD5Mechanism returns CRAM-MD5 mechanism, secrets of the users are returned by lookup
+func CRAMMD5Mechanism(lookup CRAMMD5Lookup) SASLMechanism {
+	return &cramMechanism{lookup: lookup}
+}
+
+// CRAMMD5Secret returns the stored secret of the password for CRAM-MD5, i.e. MD5 states after hashing
+// the inner and outer padded key of HMAC
+func CRAMMD5Secret(password []byte) []byte {
+	key := password
+	if len(key) > md5.BlockSize {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+	ipad := make([]byte, md5.BlockSize)
+	opad := make([]byte, md5.BlockSize)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+
+	var secret []byte
+	for _, pad := range [][]byte{ipad, opad} {
+		h := md5.New()
+		h.Write(pad)
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			// md5 state can always be marshaled
+			panic(err)
+		}
+		secret = append(secret, state...)
+	}
+	return secret
+}
+
+// cramDigest computes HMAC-MD5 of the challenge from the secret made by CRAMMD5Secret
+func cramDigest(secret, challenge []byte) ([]byte, error) {
+	if len(secret)%2 != 0 {
+		return nil, fmt.Errorf("invalid CRAM-MD5 secret")
+	}
+	inner, outer := md5.New(), md5.New()
+	if err := inner.(encoding.BinaryUnmarshaler).UnmarshalBinary(secret[:len(secret)/2]); err != nil {
+		return nil, err
+	}
+	if err := outer.(encoding.BinaryUnmarshaler).UnmarshalBinary(secret[len(secret)/2:]); err != nil {
+		return nil, err
+	}
+	inner.Write(challenge)
+	outer.Write(inner.Sum(nil))
+	return outer.Sum(nil), nil
+}
+
+type cramMechanism struct {
+	lookup CRAMMD5Lookup
+}
+
+func (m *cramMechanism) Name() string {
+	return "CRAM-MD5"
+}
+
+func (m *cramMechanism) Start(peer *Peer) SASLServer {
+	return &cramServer{mech: m, peer: peer}
+}
+
+type cramServer struct {
+	mech      *cramMechanism
+	peer      *Peer
+	challenge []byte
+}
+
+func (c *cramServer) Next(ctx context.Context, response []byte) ([]byte, bool, error) {
+	if c.challenge == nil {
+		// the mechanism doesn't have initial response
+		if len(response) != 0 {
+			return nil, false, ErrAuthMalformed
+		}
+		nonce := make([]byte, 8)
+		rand.Read(nonce)
+		c.challenge = []byte(fmt.Sprintf("<%s.%d@%s>", hex.EncodeToString(nonce), time.Now().Unix(), c.peer.ServerName))
+		return c.challenge, false, nil
+	}
+
+	i := bytes.LastIndexByte(response, ' ')
+	if i <= 0 || len(response)-i-1 != hex.EncodedLen(md5.Size) {
+		return nil, false, ErrAuthMalformed
+	}
+	digest := make([]byte, md5.Size)
+	if _, err := hex.Decode(digest, response[i+1:]); err != nil {
+		return nil, false, ErrAuthMalformed
+	}
+	c.peer.Username = string(response[:i])
+
+	secret, err := c.mech.lookup(ctx, c.peer, c.peer.Username)
+	if err != nil {
+		return nil, false, err
+	}
+	if secret == nil {
+		return nil, false, ErrAuthFailed
+	}
+	expected, err := cramDigest(secret, c.challenge)
+	if err != nil {
+		return nil, false, err
+	}
+	if !hmac.Equal(expected, digest) {
+		return nil, false, ErrAuthFailed
+	}
+	return nil, true, nil
+}
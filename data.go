@@ -0,0 +1,130 @@
+package gosmtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+/*
+RFC 5321 section 4.5.2, transparency of the message data
+
+	Before sending a line of mail text, the SMTP client checks the first
+	character of the line.  If it is a period, one additional period is
+	inserted at the beginning of the line.
+
+	When a line of mail text is received by the SMTP server, it checks the
+	line.  If the line is composed of a single period, it is treated as the
+	end of mail indicator.  If the first character is a period and there are
+	other characters on the line, the first character is deleted.
+
+Only <CRLF>.<CRLF> ends the data, treating bare LF as line ending makes the server
+vulnerable to SMTP smuggling, https://www.postfix.org/smtp-smuggling.html
+*/
+
+// BareLineEndingPolicy sets how bare CR and LF characters in message data are handled
+type BareLineEndingPolicy int
+
+const (
+	// BareLineEndingReject - the message is read till the end and rejected
+	BareLineEndingReject BareLineEndingPolicy = iota
+	// BareLineEndingNormalize - bare CR and LF are replaced by CRLF
+	BareLineEndingNormalize
+	// BareLineEndingAccept - bare CR and LF are kept in the message as they are
+	BareLineEndingAccept
+)
+
+// dataFlushSize is how much data is buffered before it's written out
+const dataFlushSize = 4096
+
+var (
+	errMessageTooBig  = errors.New("message exceeds maximum size")
+	errBareLineEnding = errors.New("bare CR or LF in message data")
+)
+
+// readData reads message data up to the terminating <CRLF>.<CRLF>, removes dot-stuffing and writes
+// the data to w, maxSize limits the size of the data (no limit if 0)
+// the whole message is always read, so the session can continue after errMessageTooBig or errBareLineEnding
+func readData(r *bufio.Reader, w io.Writer, maxSize int64, policy BareLineEndingPolicy) (int64, error) {
+	var (
+		buf       = make([]byte, 0, dataFlushSize)
+		size      int64
+		afterCRLF = true // the data starts right after CRLF of the DATA command
+		tooBig    bool
+		bare      bool
+		writeErr  error
+	)
+	write := func(b ...byte) {
+		if tooBig || writeErr != nil {
+			return
+		}
+		if maxSize > 0 && size+int64(len(b)) > maxSize {
+			tooBig = true
+			return
+		}
+		size += int64(len(b))
+		buf = append(buf, b...)
+		if len(buf) >= dataFlushSize {
+			_, writeErr = w.Write(buf)
+			buf = buf[:0]
+		}
+	}
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return size, err
+		}
+
+		if afterCRLF && c == '.' {
+			afterCRLF = false
+			if next, _ := r.Peek(2); string(next) == "\r\n" {
+				r.Discard(2)
+				break
+			}
+			// leading dot added by the client
+			continue
+		}
+		afterCRLF = false
+
+		switch c {
+		case '\r':
+			if next, _ := r.Peek(1); len(next) == 1 && next[0] == '\n' {
+				r.Discard(1)
+				write('\r', '\n')
+				afterCRLF = true
+				continue
+			}
+			bare = true
+			switch policy {
+			case BareLineEndingNormalize:
+				write('\r', '\n')
+			case BareLineEndingAccept:
+				write(c)
+			}
+		case '\n':
+			bare = true
+			switch policy {
+			case BareLineEndingNormalize:
+				write('\r', '\n')
+			case BareLineEndingAccept:
+				write(c)
+			}
+		default:
+			write(c)
+		}
+	}
+
+	if writeErr == nil && len(buf) > 0 {
+		_, writeErr = w.Write(buf)
+	}
+	switch {
+	case writeErr != nil:
+		return size, writeErr
+	case tooBig:
+		return size, errMessageTooBig
+	case bare && policy == BareLineEndingReject:
+		return size, errBareLineEnding
+	}
+	return size, nil
+}
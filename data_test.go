@@ -0,0 +1,78 @@
+package gosmtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadData(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		policy  BareLineEndingPolicy
+		maxSize int64
+		data    string
+		err     error
+	}{
+		{"simple", "Subject: hi\r\n\r\nHello\r\n.\r\n", BareLineEndingReject, 0, "Subject: hi\r\n\r\nHello\r\n", nil},
+		{"empty", ".\r\n", BareLineEndingReject, 0, "", nil},
+		{"whitespace kept", "  indented \t\r\n\r\n.\r\n", BareLineEndingReject, 0, "  indented \t\r\n\r\n", nil},
+		{"dot-stuffing", "..\r\n..leading\r\nmid.dle.\r\n.\r\n", BareLineEndingReject, 0, ".\r\n.leading\r\nmid.dle.\r\n", nil},
+		{"smuggling LF", "a\n.\nMAIL FROM:<x@y>\r\n.\r\n", BareLineEndingReject, 0, "a.MAIL FROM:<x@y>\r\n", errBareLineEnding},
+		{"smuggling LF normalized", "a\n.\r\nb\r\n.\r\n", BareLineEndingNormalize, 0, "a\r\n.\r\nb\r\n", nil},
+		{"smuggling CR accepted", "a\r.\rb\r\n.\r\n", BareLineEndingAccept, 0, "a\r.\rb\r\n", nil},
+		{"bare CR normalized", "a\rb\r\n.\r\n", BareLineEndingNormalize, 0, "a\r\nb\r\n", nil},
+		{"too big", "0123456789\r\n0123456789\r\n.\r\n", BareLineEndingReject, 15, "0123456789\r\n012", errMessageTooBig},
+		{"exact size", "0123456789\r\n.\r\n", BareLineEndingReject, 12, "0123456789\r\n", nil},
+		{"unterminated", "Hello\r\n", BareLineEndingReject, 0, "", io.EOF},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.input + "QUIT\r\n"))
+		var out bytes.Buffer
+		_, err := readData(r, &out, test.maxSize, test.policy)
+		assert.Equal(t, test.err, err, test.name)
+		assert.Equal(t, test.data, out.String(), test.name)
+		if err != io.EOF {
+			rest, _ := r.ReadString('\n')
+			assert.Equal(t, "QUIT\r\n", rest, "%s: whole message should be consumed", test.name)
+		}
+	}
+}
+
+func TestReadData_Long(t *testing.T) {
+	line := strings.Repeat("x", 3*dataFlushSize) + "\r\n"
+	r := bufio.NewReader(strings.NewReader(line + "." + line + ".\r\n"))
+	var out bytes.Buffer
+	size, err := readData(r, &out, 0, BareLineEndingReject)
+	assert.NoError(t, err)
+	assert.Equal(t, line+line, out.String())
+	assert.Equal(t, int64(2*len(line)), size)
+}
+
+func TestSession_DataSize(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Limits.MsgSize = 10
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	for _, cmd := range []string{"EHLO localhost", "MAIL FROM:<a@localhost>", "RCPT TO:<b@localhost>"} {
+		_, _, err = testCmd(c, 250, cmd)
+		assert.NoError(t, err)
+	}
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 552, "Subject: too long for the limit\r\n.")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RSET")
+	assert.NoError(t, err, "session should continue after the message")
+}
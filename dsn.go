@@ -0,0 +1,146 @@
+package gosmtp
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+RFC 3461, SMTP Service Extension for Delivery Status Notifications
+
+	ret-value       = "FULL" / "HDRS"
+	envid-value     = xtext, at most 100 characters
+	notify-esmtp-value  = "NEVER" / 1#notify-list-element
+	notify-list-element = "SUCCESS" / "FAILURE" / "DELAY"
+	orcpt-value     = addr-type ";" xtext, at most 500 characters
+	addr-type       = atom
+
+RET and ENVID are parameters of MAIL command, NOTIFY and ORCPT of RCPT command.
+*/
+
+const (
+	maxEnvelopeIDLength = 100
+	maxORCPTLength      = 500
+)
+
+var errInvalidDSN = errors.New("invalid DSN parameter")
+
+// DSNReturn is the RET parameter, which part of the message should be returned in failure DSN
+type DSNReturn string
+
+const (
+	// DSNReturnFull - full message should be returned
+	DSNReturnFull DSNReturn = "FULL"
+	// DSNReturnHeaders - only headers of the message should be returned
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// DSNNotify is the NOTIFY parameter, set of conditions under which DSN should be sent, 0 if not requested
+type DSNNotify int
+
+const (
+	// DSNNotifyNever - DSN should never be sent
+	DSNNotifyNever DSNNotify = 1 << iota
+	// DSNNotifySuccess - DSN should be sent on successful delivery
+	DSNNotifySuccess
+	// DSNNotifyFailure - DSN should be sent on delivery failure
+	DSNNotifyFailure
+	// DSNNotifyDelay - DSN should be sent if the delivery is delayed
+	DSNNotifyDelay
+)
+
+// Has returns if the condition was requested
+func (n DSNNotify) Has(cond DSNNotify) bool {
+	return n&cond != 0
+}
+
+// DSN holds DSN parameters of the MAIL command
+type DSN struct {
+	Return     DSNReturn // RET parameter, empty if not requested
+	EnvelopeID string    // ENVID parameter, xtext decoded
+}
+
+// RecipientDSN holds DSN parameters of the RCPT command
+type RecipientDSN struct {
+	Notify                DSNNotify // NOTIFY parameter
+	OriginalRecipientType string    // address type of ORCPT parameter, e.g. rfc822
+	OriginalRecipient     string    // address of ORCPT parameter, xtext decoded
+}
+
+// parseDSNReturn parses value of the RET parameter
+func parseDSNReturn(value string) (DSNReturn, error) {
+	switch ret := DSNReturn(strings.ToUpper(value)); ret {
+	case DSNReturnFull, DSNReturnHeaders:
+		return ret, nil
+	}
+	return "", errInvalidDSN
+}
+
+// parseDSNEnvelopeID parses and decodes value of the ENVID parameter
+func parseDSNEnvelopeID(value string) (string, error) {
+	id, err := decodeXtext(value)
+	if err != nil || id == "" || len(id) > maxEnvelopeIDLength || !isPrintableASCII(id) {
+		return "", errInvalidDSN
+	}
+	return id, nil
+}
+
+// parseDSNNotify parses value of the NOTIFY parameter, NEVER can't be combined with other values
+func parseDSNNotify(value string) (DSNNotify, error) {
+	var notify DSNNotify
+	for _, v := range strings.Split(strings.ToUpper(value), ",") {
+		var cond DSNNotify
+		switch v {
+		case "NEVER":
+			cond = DSNNotifyNever
+		case "SUCCESS":
+			cond = DSNNotifySuccess
+		case "FAILURE":
+			cond = DSNNotifyFailure
+		case "DELAY":
+			cond = DSNNotifyDelay
+		default:
+			return 0, errInvalidDSN
+		}
+		if notify.Has(cond) {
+			return 0, errInvalidDSN
+		}
+		notify |= cond
+	}
+	if notify.Has(DSNNotifyNever) && notify != DSNNotifyNever {
+		return 0, errInvalidDSN
+	}
+	return notify, nil
+}
+
+// parseDSNOriginalRecipient parses value of the ORCPT parameter into address type and decoded address
+func parseDSNOriginalRecipient(value string) (string, string, error) {
+	if len(value) > maxORCPTLength {
+		return "", "", errInvalidDSN
+	}
+	i := strings.IndexByte(value, ';')
+	if i <= 0 {
+		return "", "", errInvalidDSN
+	}
+	addrType := value[:i]
+	for j := 0; j < len(addrType); j++ {
+		if !isAtext(addrType[j]) {
+			return "", "", errInvalidDSN
+		}
+	}
+	addr, err := decodeXtext(value[i+1:])
+	if err != nil || addr == "" {
+		return "", "", errInvalidDSN
+	}
+	return strings.ToLower(addrType), addr, nil
+}
+
+// isPrintableASCII checks that s contains only printable US-ASCII characters
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 32 || s[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package gosmtp
+
+import (
+	"log"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDSNNotify(t *testing.T) {
+	for value, expected := range map[string]DSNNotify{
+		"NEVER":                 DSNNotifyNever,
+		"success":               DSNNotifySuccess,
+		"SUCCESS,FAILURE,DELAY": DSNNotifySuccess | DSNNotifyFailure | DSNNotifyDelay,
+		"FAILURE,DELAY":         DSNNotifyFailure | DSNNotifyDelay,
+	} {
+		notify, err := parseDSNNotify(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, notify, value)
+	}
+	for _, value := range []string{"", "NEVER,SUCCESS", "SUCCESS,SUCCESS", "SUCCESS,", "ALWAYS"} {
+		_, err := parseDSNNotify(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseDSNOriginalRecipient(t *testing.T) {
+	addrType, addr, err := parseDSNOriginalRecipient("rfc822;a+2Bb@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "rfc822", addrType)
+	assert.Equal(t, "a+b@example.com", addr)
+
+	addrType, _, err = parseDSNOriginalRecipient("RFC822;a@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "rfc822", addrType)
+
+	for _, value := range []string{"a@example.com", ";a@example.com", "rfc822;", "rfc822;a+2b@example.com", "rf c;a"} {
+		_, _, err := parseDSNOriginalRecipient(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseDSNMail(t *testing.T) {
+	ret, err := parseDSNReturn("hdrs")
+	assert.NoError(t, err)
+	assert.Equal(t, DSNReturnHeaders, ret)
+	_, err = parseDSNReturn("BODY")
+	assert.Error(t, err)
+
+	id, err := parseDSNEnvelopeID("QQ+2B314661")
+	assert.NoError(t, err)
+	assert.Equal(t, "QQ+314661", id)
+	_, err = parseDSNEnvelopeID("+0A")
+	assert.Error(t, err, "envelope ID has to be printable")
+}
+
+func TestSession_DSN(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	envs := make(chan Envelope, 1)
+	srv.Handler = func(peer *Peer, env *Envelope) (string, error) {
+		envs <- *env
+		return "", nil
+	}
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, msg, err := testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "\nDSN\n")
+
+	for _, cmd := range []string{
+		"MAIL FROM:<a@localhost> RET=HDRS ENVID=QQ314661",
+		"RCPT TO:<b@localhost> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;b+2Bx@localhost",
+		"RCPT TO:<c@localhost>",
+	} {
+		_, _, err = testCmd(c, 250, cmd)
+		assert.NoError(t, err)
+	}
+	_, _, err = testCmd(c, 501, "RCPT TO:<d@localhost> NOTIFY=NEVER,DELAY")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "Subject: dsn\r\n.")
+	assert.NoError(t, err)
+
+	env := <-envs
+	assert.Equal(t, DSN{Return: DSNReturnHeaders, EnvelopeID: "QQ314661"}, env.DSN)
+	assert.Equal(t, []RecipientDSN{
+		{Notify: DSNNotifySuccess | DSNNotifyFailure, OriginalRecipientType: "rfc822", OriginalRecipient: "b+x@localhost"},
+		{},
+	}, env.RcptDSN)
+
+	_, _, err = testCmd(c, 501, "MAIL FROM:<a@localhost> RET=BODY")
+	assert.NoError(t, err)
+}
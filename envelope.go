@@ -4,18 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"io"
 	"net/mail"
+	"os"
 )
 
 // Envelope represents a message envelope
 type Envelope struct {
-	MailFrom *mail.Address   // Envelope sender
+	MailFrom *mail.Address   // Envelope sender, empty Address for the null reverse-path <>
 	MailTo   []*mail.Address // Envelope recipients
 	Mail     *mail.Message   // Final message
 	Priority int
+	DSN      DSN            // DSN parameters of MAIL command
+	SMTPUTF8 bool           // MAIL command had SMTPUTF8 parameter, addresses and headers may contain UTF-8
+	RcptDSN  []RecipientDSN // DSN parameters of RCPT commands, in the same order as MailTo
+	BodyType BodyType       // BODY parameter of MAIL command, empty if not given, i.e. 7-bit
+	EightBit bool           // message data contain 8-bit octets, see ConvertTo7Bit for relaying to 7-bit server
+	Auth     string         // AUTH parameter of MAIL command, the original submitter, empty for <> or unauthenticated client
 
-	data    *bytes.Buffer     // data stores the header and message body
+	data    *bytes.Buffer     // data stores the header and message body, unless it's spooled
+	file    *os.File          // spool file of message bigger than spoolThreshold
+	size    int64             // size of the message data
 	headers map[string]string // New headers added by server
+
+	spoolThreshold int64  // message data bigger than this are moved to spool file, never if 0
+	spoolDir       string // directory for the spool files, default temporary directory if empty
 }
 
 func NewEnvelope() *Envelope {
@@ -28,7 +41,7 @@ func NewEnvelope() *Envelope {
 
 // Close the envelope before handing it futher
 func (e *Envelope) Close() (err error) {
-	e.Mail, err = mail.ReadMessage(bufio.NewReader(e.data))
+	e.Mail, err = mail.ReadMessage(bufio.NewReader(e.DataReader()))
 	if err != nil {
 		return
 	}
@@ -49,31 +62,100 @@ func (e *Envelope) IsSet() bool {
 }
 
 // Reader returns reader for envelope data
+// spooled message is read into memory, use DataReader to read it from the spool file
 func (e *Envelope) Reader() *bytes.Reader {
-	return bytes.NewReader(e.data.Bytes())
+	return bytes.NewReader(e.Bytes())
 }
 
+// Bytes returns envelope data, spooled message is read into memory
 func (e *Envelope) Bytes() []byte {
-	return e.data.Bytes()
+	if e.file == nil {
+		return e.data.Bytes()
+	}
+	data, err := io.ReadAll(e.DataReader())
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// DataReader returns reader for envelope data, which reads spooled message directly from the spool file
+// the reader is valid only until the envelope is reset, i.e. until the Handler returns
+func (e *Envelope) DataReader() io.ReadSeeker {
+	if e.file != nil {
+		return io.NewSectionReader(e.file, 0, e.size)
+	}
+	return bytes.NewReader(e.data.Bytes())
+}
+
+// Size returns size of the envelope data
+func (e *Envelope) Size() int64 {
+	return e.size
+}
+
+// Spooled returns if the message data are stored in spool file instead of memory
+func (e *Envelope) Spooled() bool {
+	return e.file != nil
 }
 
 // Reset resets envelope to initial state
 func (e *Envelope) Reset() error {
 	e.MailTo = []*mail.Address{}
 	e.MailFrom = nil
+	e.DSN = DSN{}
+	e.RcptDSN = nil
+	e.SMTPUTF8 = false
+	e.BodyType = ""
+	e.EightBit = false
+	e.Auth = ""
 	if e.data != nil {
 		e.data.Reset()
 	}
+	e.removeSpool()
 	for key, _ := range e.headers {
 		delete(e.headers, key)
 	}
 	return nil
 }
 
-// AddRecipient adds recipient to envelope recipients
-// returns error if maximum number of recipients is reached
+// CanDowngrade returns if the envelope can be relayed to server without SMTPUTF8 support, i.e. all the addresses
+// have ASCII local parts and domains can be converted by AddressToASCII, message headers are not checked
+func (e *Envelope) CanDowngrade() bool {
+	if !e.SMTPUTF8 {
+		return true
+	}
+	addrs := append([]*mail.Address{e.MailFrom}, e.MailTo...)
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+		if _, err := AddressToASCII(addr.Address); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// AddRecipient adds recipient without DSN parameters to envelope recipients
+// the limit of recipients is enforced by the session, the error is always nil
 func (e *Envelope) AddRecipient(rcpt *mail.Address) error {
+	return e.addRecipient(rcpt, RecipientDSN{})
+}
+
+// recipientDSN returns DSN parameters of the recipient
+func (e *Envelope) recipientDSN(rcpt *mail.Address) RecipientDSN {
+	for i, to := range e.MailTo {
+		if i < len(e.RcptDSN) && (to == rcpt || to.Address == rcpt.Address) {
+			return e.RcptDSN[i]
+		}
+	}
+	return RecipientDSN{}
+}
+
+// addRecipient adds recipient together with its DSN parameters
+func (e *Envelope) addRecipient(rcpt *mail.Address, dsn RecipientDSN) error {
 	e.MailTo = append(e.MailTo, rcpt)
+	e.RcptDSN = append(e.RcptDSN, dsn)
 	return nil
 }
 
@@ -82,20 +164,61 @@ func (e *Envelope) BeginData() error {
 		return errors.New("554 5.5.1 Error: no valid recipients")
 	}
 	e.data = bytes.NewBuffer([]byte{})
+	e.removeSpool()
 	return nil
 }
 
-// Write writes bytes into the envelope buffer
+// Write writes bytes into the envelope buffer, the data are moved to spool file once they are over the threshold
 func (e *Envelope) Write(line []byte) (int, error) {
-	return e.data.Write(line)
+	if e.file == nil && e.spoolThreshold > 0 && e.size+int64(len(line)) > e.spoolThreshold {
+		if err := e.spool(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if e.file != nil {
+		n, err = e.file.Write(line)
+	} else {
+		n, err = e.data.Write(line)
+	}
+	e.size += int64(n)
+	return n, err
 }
 
 // WriteString writes string into the envelope buffer
 func (e *Envelope) WriteString(line string) (int, error) {
-	return e.data.WriteString(line)
+	return e.Write([]byte(line))
 }
 
 // WriteLine writes data into the envelope followed by new line
 func (e *Envelope) WriteLine(line []byte) (int, error) {
-	return e.data.Write(append(line, []byte("\r\n")...))
+	return e.Write(append(line, []byte("\r\n")...))
+}
+
+// spool moves data from memory to new spool file
+func (e *Envelope) spool() error {
+	f, err := os.CreateTemp(e.spoolDir, "gosmtp-*.eml")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(e.data.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	e.data.Reset()
+	e.file = f
+	return nil
+}
+
+// removeSpool removes the spool file, if there is any
+func (e *Envelope) removeSpool() {
+	e.size = 0
+	if e.file == nil {
+		return
+	}
+	e.file.Close()
+	os.Remove(e.file.Name())
+	e.file = nil
 }
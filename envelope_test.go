@@ -3,6 +3,7 @@ package gosmtp
 import (
 	"bytes"
 	"net/mail"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -43,3 +44,29 @@ func TestEnvelope_Reset(t *testing.T) {
 	assert.Nil(t, env.MailFrom, "mail from should be nil after reset")
 	assert.Equal(t, 0, len(env.MailTo), "mail recipient should be empty after reset")
 }
+
+func TestEnvelope_Spool(t *testing.T) {
+	env := NewEnvelope()
+	env.spoolThreshold = 10
+	env.spoolDir = t.TempDir()
+	e1, _ := parseAddress("hello@example.com")
+	env.AddRecipient(e1)
+	assert.NoError(t, env.BeginData())
+
+	env.WriteString("Subject: ")
+	assert.False(t, env.Spooled(), "data under the threshold should stay in memory")
+	env.WriteLine([]byte("spooled"))
+	env.WriteString("\r\nbody\r\n")
+	assert.True(t, env.Spooled(), "data over the threshold should be spooled")
+	assert.Equal(t, int64(26), env.Size())
+	assert.Equal(t, "Subject: spooled\r\n\r\nbody\r\n", string(env.Bytes()))
+
+	assert.NoError(t, env.Close())
+	assert.Equal(t, "spooled", env.Mail.Header.Get("Subject"))
+
+	name := env.file.Name()
+	env.Reset()
+	assert.False(t, env.Spooled())
+	_, err := os.Stat(name)
+	assert.True(t, os.IsNotExist(err), "spool file should be removed after reset")
+}
@@ -0,0 +1,144 @@
+package gosmtp
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Extension is keyword of SMTP service extension announced in EHLO reply
+type Extension string
+
+const (
+	Ext8BitMIME            Extension = "8BITMIME"            // https://tools.ietf.org/html/rfc6152
+	ExtChunking            Extension = "CHUNKING"            // https://tools.ietf.org/html/rfc3030
+	ExtBinaryMIME          Extension = "BINARYMIME"          // https://tools.ietf.org/html/rfc3030, requires CHUNKING
+	ExtSMTPUTF8            Extension = "SMTPUTF8"            // https://tools.ietf.org/html/rfc6531
+	ExtPipelining          Extension = "PIPELINING"          // https://tools.ietf.org/html/rfc2920
+	ExtDSN                 Extension = "DSN"                 // https://tools.ietf.org/html/rfc3461
+	ExtMTPriority          Extension = "MT-PRIORITY"         // https://tools.ietf.org/html/rfc6710, disabled by default
+	ExtEnhancedStatusCodes Extension = "ENHANCEDSTATUSCODES" // https://tools.ietf.org/html/rfc2034
+	ExtStartTLS            Extension = "STARTTLS"            // https://tools.ietf.org/html/rfc3207, needs TLSStartTLS listener
+	ExtAuth                Extension = "AUTH"                // https://tools.ietf.org/html/rfc4954, needs Server.Auth
+	ExtXClient             Extension = "XCLIENT"             // http://www.postfix.org/XCLIENT_README.html, needs TrustedNetworks
+	ExtXForward            Extension = "XFORWARD"            // http://www.postfix.org/XFORWARD_README.html, needs TrustedNetworks
+	ExtHelp                Extension = "HELP"                // https://tools.ietf.org/html/rfc821
+	ExtSize                Extension = "SIZE"                // https://tools.ietf.org/html/rfc1870
+)
+
+// extension describes when and how the extension is announced
+type extension struct {
+	keyword   Extension
+	off       bool                    // disabled unless enabled in Server.Extensions
+	requires  Extension               // the extension can't be used without another one
+	available func(s *session) bool   // the extension depends on the session or server configuration
+	params    func(s *session) string // parameters announced after the keyword
+}
+
+// extensions in order of EHLO reply
+var extensions = []extension{
+	{keyword: Ext8BitMIME},
+	{keyword: ExtChunking},
+	{keyword: ExtBinaryMIME, requires: ExtChunking},
+	{keyword: ExtSMTPUTF8},
+	{keyword: ExtPipelining},
+	{keyword: ExtDSN},
+	// the priority is only stored in the envelope, the handler has to honour it
+	{keyword: ExtMTPriority, off: true},
+	{keyword: ExtEnhancedStatusCodes},
+	{keyword: ExtStartTLS, available: func(s *session) bool {
+		return s.listener.TLSMode == TLSStartTLS && !s.tls
+	}},
+	/*
+		RFC4954 notes: A server implementation MUST
+		implement a configuration in which it does NOT
+		permit any plaintext password mechanisms, unless
+		either the STARTTLS [SMTP-TLS] command has been negotiated...
+	*/
+	{keyword: ExtAuth, available: func(s *session) bool {
+		return len(s.authMechanismNames()) != 0 && s.listener.TLSMode != TLSNone
+	}, params: func(s *session) string {
+		return strings.Join(s.authMechanismNames(), " ")
+	}},
+	{keyword: ExtXClient, available: func(s *session) bool {
+		return s.xclientTrusted
+	}, params: func(*session) string {
+		return xclientAttrs
+	}},
+	{keyword: ExtXForward, available: func(s *session) bool {
+		return s.xclientTrusted
+	}, params: func(*session) string {
+		return xforwardAttrs
+	}},
+	{keyword: ExtHelp},
+	// SIZE without parameter means there's no fixed limit
+	{keyword: ExtSize, params: func(s *session) string {
+		if s.listener.Limits.MsgSize > 0 {
+			return strconv.FormatInt(s.listener.Limits.MsgSize, 10)
+		}
+		return ""
+	}},
+}
+
+// paramExtensions are the extensions which define MAIL and RCPT parameters
+var paramExtensions = map[string]Extension{
+	"SIZE":        ExtSize,
+	"BODY":        Ext8BitMIME,
+	"SMTPUTF8":    ExtSMTPUTF8,
+	"AUTH":        ExtAuth,
+	"MT-PRIORITY": ExtMTPriority,
+	"RET":         ExtDSN,
+	"ENVID":       ExtDSN,
+	"NOTIFY":      ExtDSN,
+	"ORCPT":       ExtDSN,
+}
+
+// enhancedCodeRe matches enhanced status code after the basic code of a reply
+var enhancedCodeRe = regexp.MustCompile(`^([0-9]{3}[ -])[245]\.[0-9]{1,3}\.[0-9]{1,3}( |$)`)
+
+// extensionEnabled checks if the extension is enabled by the configuration and available in the session
+func (s *session) extensionEnabled(keyword Extension) bool {
+	for _, ext := range extensions {
+		if ext.keyword != keyword {
+			continue
+		}
+		enabled, ok := s.srv.Extensions[keyword]
+		if !ok {
+			enabled = !ext.off
+		}
+		if ext.requires != "" && !s.extensionEnabled(ext.requires) {
+			return false
+		}
+		return enabled && (ext.available == nil || ext.available(s))
+	}
+	return false
+}
+
+// paramEnabled checks if the extension which defines the MAIL or RCPT parameter is enabled
+func (s *session) paramEnabled(keyword string) bool {
+	ext, ok := paramExtensions[keyword]
+	return !ok || s.extensionEnabled(ext)
+}
+
+// extensionLines returns the enabled extensions with their parameters, one per EHLO reply line
+func (s *session) extensionLines() []string {
+	lines := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		if !s.extensionEnabled(ext.keyword) {
+			continue
+		}
+		line := string(ext.keyword)
+		if ext.params != nil {
+			if params := ext.params(s); params != "" {
+				line += " " + params
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// stripEnhancedCode removes enhanced status code from the reply, used if ENHANCEDSTATUSCODES is disabled
+func stripEnhancedCode(msg string) string {
+	return enhancedCodeRe.ReplaceAllString(msg, "$1")
+}
@@ -0,0 +1,116 @@
+package gosmtp
+
+import (
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripEnhancedCode(t *testing.T) {
+	assert.Equal(t, "250 OK", stripEnhancedCode("250 2.0.0 OK"))
+	assert.Equal(t, "550-Rejected", stripEnhancedCode("550-5.7.1 Rejected"))
+	assert.Equal(t, "220 mail.example ESMTP", stripEnhancedCode("220 mail.example ESMTP"))
+	assert.Equal(t, "250-SIZE 1000", stripEnhancedCode("250-SIZE 1000"))
+}
+
+func TestSession_Extensions(t *testing.T) {
+	limits := DefaultLimits
+	limits.MsgSize = 1000
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags), limits)
+	srv.Hostname = "mx.example.com"
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, msg, err := testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	assert.Equal(t, "mx.example.com hello pipe\n"+
+		"8BITMIME\nCHUNKING\nBINARYMIME\nSMTPUTF8\nPIPELINING\nDSN\nENHANCEDSTATUSCODES\nHELP\nSIZE 1000", msg)
+	_, _, err = testCmd(c, 555, "MAIL FROM:<sender@[127.0.0.1]> MT-PRIORITY=1")
+	assert.NoError(t, err, "MT-PRIORITY is disabled by default")
+	_, msg, err = testCmd(c, 552, "MAIL FROM:<sender@[127.0.0.1]> SIZE=1001")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^5\.\d+\.\d+ `, msg)
+	_, msg, err = testCmd(c, 250, "HELO localhost")
+	assert.NoError(t, err)
+	assert.Equal(t, "mx.example.com hello pipe", msg)
+
+	srv.Extensions = map[Extension]bool{
+		ExtChunking:            false,
+		ExtDSN:                 false,
+		ExtMTPriority:          true,
+		ExtEnhancedStatusCodes: false,
+	}
+	_, msg, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	assert.Equal(t, "mx.example.com hello pipe\n"+
+		"8BITMIME\nSMTPUTF8\nPIPELINING\nMT-PRIORITY\nHELP\nSIZE 1000", msg, "BINARYMIME requires CHUNKING")
+	_, msg, err = testCmd(c, 555, "MAIL FROM:<sender@[127.0.0.1]> RET=HDRS")
+	assert.NoError(t, err)
+	assert.NotRegexp(t, `^5\.`, msg, "enhanced status codes shouldn't be sent")
+	_, _, err = testCmd(c, 555, "MAIL FROM:<sender@[127.0.0.1]> BODY=BINARYMIME")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@[127.0.0.1]> MT-PRIORITY=1")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RCPT TO:<rcpt@[127.0.0.1]>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 502, "BDAT 0 LAST")
+	assert.NoError(t, err)
+}
+
+func TestSession_ExtensionSizeUnlimited(t *testing.T) {
+	limits := DefaultLimits
+	limits.MsgSize = 0
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags), limits)
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, msg, err := testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	assert.Regexp(t, "\nSIZE$", msg)
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@[127.0.0.1]> SIZE=1000000000")
+	assert.NoError(t, err, "SIZE without a limit accepts any size")
+}
+
+func TestSession_ExtensionCommands(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.TLSConfig = testTLSConfig(t)
+	srv.Auth(func(*Peer, []byte) (bool, error) { return true, nil })
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv.TrustedNetworks = []*net.IPNet{loopback}
+	srv.Extensions = map[Extension]bool{ExtStartTLS: false, ExtAuth: false, ExtXClient: false, ExtXForward: false}
+	defer srv.Close()
+
+	c, err := textproto.Dial("tcp", startTestListener(t, srv, Listener{TLSMode: TLSStartTLS}))
+	assert.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	// disabled extensions aren't only hidden from EHLO
+	for _, cmd := range []string{"STARTTLS", "AUTH PLAIN", "XCLIENT NAME=client.example.com", "XFORWARD NAME=client.example.com"} {
+		_, _, err = testCmd(c, 502, cmd)
+		assert.NoError(t, err, cmd)
+	}
+
+	// AUTH isn't available on listener without TLS
+	srv.Extensions = nil
+	plain, err := textproto.Dial("tcp", startTestListener(t, srv, Listener{TLSMode: TLSNone}))
+	assert.NoError(t, err)
+	defer plain.Close()
+	_, _, err = plain.ReadResponse(220)
+	assert.NoError(t, err)
+	_, msg, err := testCmd(plain, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	assert.NotContains(t, msg, "AUTH")
+	_, _, err = testCmd(plain, 502, "AUTH PLAIN")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,90 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto/x509"
+)
+
+/*
+RFC 4422, Simple Authentication and Security Layer (SASL), Appendix A
+
+	external-resp = *( UTF8-char-no-nul )
+
+	The EXTERNAL mechanism allows a client to request the server to use
+	credentials established by means external to the mechanism to
+	authenticate the client.  The external means may be, for instance,
+	IP Security or TLS services.
+
+The client is authenticated by its TLS certificate, EXTERNAL is offered only if the client presented
+a certificate verified against TLSConfig.ClientCAs, e.g. with ClientAuth set to tls.VerifyClientCertIfGiven.
+*/
+
+// CertificateMapper returns the user of the verified certificate chains of the client, "" if the certificate
+// doesn't belong to any user
+type CertificateMapper func(ctx context.Context, peer *Peer, chains [][]*x509.Certificate) (string, error)
+
+// ExternalMechanism returns EXTERNAL mechanism authenticating the client by TLS certificate mapped to the user by f
+func ExternalMechanism(f CertificateMapper) SASLMechanism {
+	return &externalMechanism{mapper: f}
+}
+
+type externalMechanism struct {
+	mapper CertificateMapper
+}
+
+func (m *externalMechanism) Name() string {
+	return "EXTERNAL"
+}
+
+func (m *externalMechanism) Start(peer *Peer) SASLServer {
+	return &externalServer{mech: m, peer: peer}
+}
+
+type externalServer struct {
+	mech *externalMechanism
+	peer *Peer
+}
+
+func (e *externalServer) Next(ctx context.Context, response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	if !hasClientCertificate(e.peer) {
+		return nil, false, ErrAuthFailed
+	}
+	username, err := e.mech.mapper(ctx, e.peer, e.peer.TLS.VerifiedChains)
+	if err != nil {
+		return nil, false, err
+	}
+	if username == "" {
+		return nil, false, ErrAuthFailed
+	}
+	// the response is authorization identity
+	e.peer.Username = username
+	e.peer.AuthorizationID = string(response)
+	return nil, true, nil
+}
+
+// hasClientCertificate checks if the peer presented TLS certificate verified by the server
+func hasClientCertificate(peer *Peer) bool {
+	return peer.TLS != nil && len(peer.TLS.VerifiedChains) > 0
+}
+
+// certificateAuth authenticates the client by its TLS certificate right after the handshake if it's enabled
+func (s *session) certificateAuth() {
+	if s.srv.CertificateAuth == nil || s.peer.Authenticated || !hasClientCertificate(s.peer) {
+		return
+	}
+	ctx, done := s.hookContext(s.listener.Limits.CmdInput)
+	username, err := s.srv.CertificateAuth(ctx, s.peer, s.peer.TLS.VerifiedChains)
+	done()
+	if err != nil {
+		s.log.Printf("ERROR: certificate authentication: '%s'", err.Error())
+		return
+	}
+	if username != "" {
+		s.log.Printf("INFO: %s authenticated by TLS certificate", username)
+		s.peer.Username = username
+		s.peer.Authenticated = true
+	}
+}
@@ -0,0 +1,140 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net/smtp"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testClientCertificate creates CA verifying client certificates of the server TLS configuration
+// and returns client certificate of the name issued by it
+func testClientCertificate(t *testing.T, config *tls.Config, name string) tls.Certificate {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	config.ClientCAs.AddCert(ca)
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testCertificateMapper maps certificates to users by their common name
+func testCertificateMapper(ctx context.Context, peer *Peer, chains [][]*x509.Certificate) (string, error) {
+	if name := chains[0][0].Subject.CommonName; name == "relay.example.com" {
+		return name, nil
+	}
+	return "", nil
+}
+
+func TestServer_AuthExternal(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	srv.TLSConfig = testTLSConfig(t)
+	cert := testClientCertificate(t, srv.TLSConfig, "relay.example.com")
+	assert.NoError(t, srv.Auth(nil, PlainMechanism(nil), ExternalMechanism(testCertificateMapper)))
+	addr := startTestListener(t, srv, Listener{TLSMode: TLSImplicit})
+
+	dial := func(certs ...tls.Certificate) *smtp.Client {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := smtp.NewClient(conn, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// EXTERNAL isn't offered without client certificate
+	c := dial()
+	_, mechs := c.Extension("AUTH")
+	assert.Equal(t, "PLAIN", mechs)
+	_, err := testAuthCmd(c.Text, 504, "AUTH EXTERNAL =")
+	assert.NoError(t, err)
+	c.Close()
+
+	c = dial(cert)
+	_, mechs = c.Extension("AUTH")
+	assert.Equal(t, "PLAIN EXTERNAL", mechs)
+	_, err = testAuthCmd(c.Text, 535, "AUTH EXTERNAL dXNlcg==")
+	assert.NoError(t, err, "authorization identity has to match the certificate")
+	_, err = testAuthCmd(c.Text, 334, "AUTH EXTERNAL")
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 235, "=")
+	assert.NoError(t, err)
+	c.Close()
+
+	// certificate of unknown user
+	other := testClientCertificate(t, srv.TLSConfig, "unknown.example.com")
+	c = dial(other)
+	_, err = testAuthCmd(c.Text, 535, "AUTH EXTERNAL =")
+	assert.NoError(t, err)
+	c.Close()
+}
+
+func TestServer_CertificateAuth(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	srv.TLSConfig = testTLSConfig(t)
+	cert := testClientCertificate(t, srv.TLSConfig, "relay.example.com")
+	srv.CertificateAuth = testCertificateMapper
+	srv.Auth(func(*Peer, []byte) (bool, error) { return false, nil })
+	addr := startTestListener(t, srv, Listener{TLSMode: TLSStartTLS, RequireAuth: true})
+
+	c, err := smtp.Dial(addr)
+	assert.NoError(t, err)
+	assert.NoError(t, c.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+	assert.Error(t, c.Mail("sender@localhost"), "client without certificate has to authenticate")
+	c.Close()
+
+	c, err = smtp.Dial(addr)
+	assert.NoError(t, err)
+	assert.NoError(t, c.StartTLS(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}))
+	_, err = testAuthCmd(c.Text, 503, "AUTH PLAIN")
+	assert.NoError(t, err, "client authenticated by certificate can't authenticate again")
+	assert.NoError(t, c.Mail("sender@localhost"), "trusted client certificate should authorize relaying")
+	c.Close()
+}
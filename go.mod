@@ -1,9 +1,20 @@
 module github.com/matoous/gosmtp
 
+go 1.24.0
+
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-errors/errors v1.0.1
 	github.com/matoous/go-nanoid v0.0.0-20180926092311-3de1538a83bc
 	github.com/signalsciences/tlstext v0.0.0-20170724030830-3693a8d42128
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/net v0.47.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,319 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+RFC 7519, JSON Web Token (JWT), RFC 7517, JSON Web Key (JWK)
+
+	JWT = BASE64URL(header) "." BASE64URL(claims) "." BASE64URL(signature)
+
+JWTValidator checks signed tokens locally against JSON Web Key Set, e.g. the one published by
+the identity provider at jwks_uri, so no request to the provider is needed for each login.
+RS256/384/512, ES256/384/512 and EdDSA signatures are supported.
+*/
+
+var (
+	errJWTMalformed = errors.New("malformed JWT")
+	errJWTSignature = errors.New("invalid JWT signature")
+	errJWTExpired   = errors.New("JWT expired")
+	errJWTClaims    = errors.New("invalid JWT claims")
+)
+
+// JWKS is a parsed JSON Web Key Set
+type JWKS struct {
+	keys []jwk
+}
+
+// jwk is a public key of the set
+type jwk struct {
+	id  string
+	alg string
+	key crypto.PublicKey
+}
+
+// ParseJWKS parses JSON Web Key Set, e.g. {"keys": [{"kty": "RSA", "kid": "1", "n": "...", "e": "AQAB"}]}
+// RSA, EC (P-256, P-384, P-521) and OKP (Ed25519) keys are supported, keys of other types are skipped.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	jwks := &JWKS{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAKey(k.N, k.E)
+		case "EC":
+			key, err = parseECKey(k.Crv, k.X, k.Y)
+		case "OKP":
+			if k.Crv != "Ed25519" {
+				continue
+			}
+			var x []byte
+			x, err = base64.RawURLEncoding.DecodeString(k.X)
+			if err == nil && len(x) != ed25519.PublicKeySize {
+				err = errors.New("invalid Ed25519 key size")
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		jwks.keys = append(jwks.keys, jwk{id: k.Kid, alg: k.Alg, key: key})
+	}
+	return jwks, nil
+}
+
+// LoadJWKS reads JSON Web Key Set from file
+func LoadJWKS(path string) (*JWKS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+func parseRSAKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func parseECKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("invalid EC key")
+	}
+	return key, nil
+}
+
+// JWTValidator validates JWT bearer tokens, use its Validate method as TokenValidator
+type JWTValidator struct {
+	Keys          *JWKS         // keys of the token issuer
+	Issuer        string        // required iss claim, not checked if empty
+	Audience      string        // required aud claim, not checked if empty
+	UsernameClaim string        // claim with the user name, "sub" if empty, e.g. email
+	Leeway        time.Duration // allowed clock skew for exp and nbf claims
+}
+
+// Validate checks signature and claims of the token, the user from the token has to match peer.Username,
+// peer.Username is set from the token if the client didn't name the user
+func (v *JWTValidator) Validate(ctx context.Context, peer *Peer, token string) (bool, error) {
+	claims, err := v.Parse(token)
+	if err != nil {
+		return false, nil
+	}
+	claim := v.UsernameClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	username, _ := claims[claim].(string)
+	if username == "" {
+		return false, nil
+	}
+	if peer.Username == "" {
+		peer.Username = username
+	}
+	return strings.EqualFold(peer.Username, username), nil
+}
+
+// Parse verifies the token and returns its claims
+func (v *JWTValidator) Parse(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	if err := v.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errJWTClaims
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return nil, errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errJWTClaims
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return nil, errJWTClaims
+	}
+	if v.Audience != "" && !jwtAudience(claims["aud"], v.Audience) {
+		return nil, errJWTClaims
+	}
+	return claims, nil
+}
+
+// verify checks the signature by the key of the id, all the keys are tried if the token has no key id
+func (v *JWTValidator) verify(alg, kid string, signed, signature []byte) error {
+	if v.Keys == nil {
+		return errJWTSignature
+	}
+	for _, k := range v.Keys.keys {
+		if (kid != "" && k.id != kid) || (k.alg != "" && k.alg != alg) {
+			continue
+		}
+		if verifyJWTSignature(alg, k.key, signed, signature) {
+			return nil
+		}
+	}
+	return errJWTSignature
+}
+
+// verifyJWTSignature verifies signature of the algorithm, "none" and HMAC are never accepted
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) bool {
+	if len(alg) < 5 && alg != "EdDSA" {
+		return false
+	}
+	var hash crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	digest := func() []byte {
+		switch hash {
+		case crypto.SHA384:
+			sum := sha512.Sum384(signed)
+			return sum[:]
+		case crypto.SHA512:
+			sum := sha512.Sum512(signed)
+			return sum[:]
+		}
+		sum := sha256.Sum256(signed)
+		return sum[:]
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || hash == 0 {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest(), signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || hash == 0 || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest(), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(k, signed, signature)
+	}
+	return false
+}
+
+// decodeJWTPart decodes base64url encoded JSON part of the token
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errJWTMalformed
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errJWTMalformed
+	}
+	return nil
+}
+
+// jwtAudience checks if aud claim, a string or array of strings, contains the audience
+func jwtAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
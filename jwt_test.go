@@ -0,0 +1,135 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testJWT signs the claims by the key
+func testJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testJWKS generates RSA, EC and Ed25519 keys and returns them with their JWKS
+func testJWKS(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, *JWKS) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPublic)},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}})
+	jwks, err := ParseJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsaKey, ecKey, edKey, jwks
+}
+
+func TestParseJWKS(t *testing.T) {
+	_, _, _, jwks := testJWKS(t)
+	assert.Len(t, jwks.keys, 3, "oct key should be skipped")
+	_, err := ParseJWKS([]byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+	assert.Error(t, err, "point is not on the curve")
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "EC", "crv": "P-192"}]}`))
+	assert.Error(t, err)
+}
+
+func TestJWTValidator_Parse(t *testing.T) {
+	rsaKey, ecKey, edKey, jwks := testJWKS(t)
+	v := &JWTValidator{Keys: jwks, Issuer: "https://idp.example.com", Audience: "smtp"}
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://idp.example.com",
+			"aud": []string{"imap", "smtp"},
+			"sub": "user@example.com",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	for _, token := range []string{
+		testJWT(t, "RS256", "rsa", rsaKey, claims(nil)),
+		testJWT(t, "ES256", "ec", ecKey, claims(nil)),
+		testJWT(t, "EdDSA", "", edKey, claims(func(c map[string]interface{}) { c["aud"] = "smtp" })),
+	} {
+		c, err := v.Parse(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "user@example.com", c["sub"])
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for name, token := range map[string]string{
+		"unknown key":     testJWT(t, "RS256", "rsa", otherKey, claims(nil)),
+		"algorithm":       testJWT(t, "ES256", "rsa", rsaKey, claims(nil)),
+		"expired":         testJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"no expiration":   testJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { delete(c, "exp") })),
+		"not yet valid":   testJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() })),
+		"issuer":          testJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["iss"] = "https://other.example.com" })),
+		"audience":        testJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { c["aud"] = "imap" })),
+		"unsigned":        strings.Join(strings.Split(testJWT(t, "RS256", "rsa", rsaKey, claims(nil)), ".")[:2], ".") + ".",
+		"malformed token": "not.a-token",
+	} {
+		_, err := v.Parse(token)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestJWTValidator_Validate(t *testing.T) {
+	rsaKey, _, _, jwks := testJWKS(t)
+	v := &JWTValidator{Keys: jwks, UsernameClaim: "email"}
+	token := testJWT(t, "RS256", "rsa", rsaKey, map[string]interface{}{
+		"sub":   "1234",
+		"email": "user@example.com",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	})
+
+	peer := &Peer{}
+	ok, err := v.Validate(context.Background(), peer, token)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "user@example.com", peer.Username, "user should be taken from the token")
+
+	ok, err = v.Validate(context.Background(), &Peer{Username: "other@example.com"}, token)
+	assert.NoError(t, err)
+	assert.False(t, ok, "token of other user should be rejected")
+}
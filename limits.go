@@ -11,6 +11,24 @@ type Limits struct {
 	MsgSize      int64         // max email size
 	BadCmds      int           // bad commands limit
 	MaxRcptCount int           // maximum number of recipients of message
+
+	// Concurrent sessions across the whole server, unlimited if 0.
+	// Connections over the limit are rejected with 421.
+	MaxConnections          int // total concurrent sessions
+	MaxConnectionsPerIP     int // concurrent sessions from one IP address
+	MaxConnectionsPerSubnet int // concurrent sessions from one subnet
+	SubnetPrefixIPv4        int // prefix length of IPv4 subnet, /24 if 0
+	SubnetPrefixIPv6        int // prefix length of IPv6 subnet, /64 if 0
+
+	// Rate limits kept in Server.RateLimitStore, exceeding them results in temporary failure.
+	// Connections are counted per IP when the session starts, per user and sender domain
+	// on the first MAIL command of the session.
+	RatePerIP           RateLimit // per client IP address
+	RatePerUser         RateLimit // per authenticated Peer.Username
+	RatePerSenderDomain RateLimit // per domain of the MAIL FROM address
+
+	// Failed authentications counted across all the sessions, locked out clients get 454.
+	AuthFailures AuthFailureLimit
 }
 
 // DefaultLimits that are applied if you do not specify custom limits
@@ -0,0 +1,143 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+)
+
+// TLSMode specifies how TLS is used on a listener
+type TLSMode int
+
+const (
+	// TLSNone - TLS is not available on the listener
+	TLSNone TLSMode = iota
+	// TLSStartTLS - connection starts in plain text and can be upgraded via STARTTLS (RFC 3207)
+	TLSStartTLS
+	// TLSImplicit - TLS is negotiated right after the connection is accepted (RFC 8314)
+	TLSImplicit
+)
+
+// String returns name of the TLS mode
+func (m TLSMode) String() string {
+	switch m {
+	case TLSStartTLS:
+		return "STARTTLS"
+	case TLSImplicit:
+		return "implicit TLS"
+	default:
+		return "none"
+	}
+}
+
+/*
+Listener describes one address the server listens on together with the role it plays,
+e.g. MX on port 25, submission with STARTTLS on port 587 and submission with implicit TLS on port 465.
+All listeners of one Server share the same Handler and shutdown path.
+Fields which are left empty fall back to the corresponding Server settings.
+*/
+type Listener struct {
+	Network     string      // network to listen on, "tcp" if empty
+	Addr        string      // address to listen on, e.g. ":587"
+	TLSMode     TLSMode     // how TLS is used on this listener
+	TLSConfig   *tls.Config // TLS configuration, Server.TLSConfig if nil
+	RequireTLS  bool        // require TLS before mail transaction
+	RequireAuth bool        // require authentication before mail transaction
+	Limits      *Limits     // session limits, Server.Limits if nil
+	LMTP        bool        // speak LMTP (RFC 2033) instead of SMTP, e.g. on "unix" Network
+
+	// PROXY protocol (v1 and v2) header is expected from connections coming from TrustedProxies,
+	// the client address from the header is used as Peer.Addr
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+
+	// Checkers specific for this listener, Server checkers are used if nil.
+	ConnectionChecker func(peer *Peer) error                     // Called upon new connection.
+	HeloChecker       func(peer *Peer, name string) error        // Called after HELO/EHLO.
+	SenderChecker     func(peer *Peer, addr *mail.Address) error // Called after MAIL FROM.
+	RecipientChecker  func(peer *Peer, addr *mail.Address) error // Called after each RCPT TO.
+
+	// Context aware checkers specific for this listener, used instead of the ones above if set.
+	ConnectionCheckerContext func(ctx context.Context, peer *Peer) error
+	HeloCheckerContext       func(ctx context.Context, peer *Peer, name string) error
+	SenderCheckerContext     func(ctx context.Context, peer *Peer, addr *mail.Address) error
+	RecipientCheckerContext  func(ctx context.Context, peer *Peer, addr *mail.Address) error
+}
+
+// errNoTLSConfig is returned when TLS is required by listener but there is no TLS configuration
+var errNoTLSConfig = errors.New("smtp: listener requires TLS but no TLS configuration was provided")
+
+// defaultListener creates listener configuration from the Server fields, used when no Listeners are configured
+func (srv *Server) defaultListener(mode TLSMode) *Listener {
+	if srv.TLSConfig == nil {
+		mode = TLSNone
+	}
+	return srv.resolveListener(&Listener{
+		Addr:        srv.Addr,
+		TLSMode:     mode,
+		RequireTLS:  srv.TLSOnly,
+		RequireAuth: len(srv.authMechanisms) != 0,
+		LMTP:        srv.LMTP,
+	})
+}
+
+// resolveListener returns copy of the listener configuration with empty fields filled from the Server
+func (srv *Server) resolveListener(l *Listener) *Listener {
+	r := *l
+	if r.Network == "" {
+		r.Network = "tcp"
+	}
+	if r.TLSConfig == nil {
+		r.TLSConfig = srv.TLSConfig
+	}
+	if r.Limits == nil {
+		limits := srv.Limits
+		r.Limits = &limits
+	}
+	r.resolveCheckers(srv)
+	return &r
+}
+
+// resolveCheckers fills checkers from the Server if the listener has none and turns
+// the plain checkers into context aware ones, so the session only calls the latter
+func (l *Listener) resolveCheckers(srv *Server) {
+	if l.ConnectionChecker == nil && l.ConnectionCheckerContext == nil {
+		l.ConnectionChecker, l.ConnectionCheckerContext = srv.ConnectionChecker, srv.ConnectionCheckerContext
+	}
+	if l.ConnectionCheckerContext == nil && l.ConnectionChecker != nil {
+		check := l.ConnectionChecker
+		l.ConnectionCheckerContext = func(_ context.Context, peer *Peer) error { return check(peer) }
+	}
+	if l.HeloChecker == nil && l.HeloCheckerContext == nil {
+		l.HeloChecker, l.HeloCheckerContext = srv.HeloChecker, srv.HeloCheckerContext
+	}
+	if l.HeloCheckerContext == nil && l.HeloChecker != nil {
+		check := l.HeloChecker
+		l.HeloCheckerContext = func(_ context.Context, peer *Peer, name string) error { return check(peer, name) }
+	}
+	if l.SenderChecker == nil && l.SenderCheckerContext == nil {
+		l.SenderChecker, l.SenderCheckerContext = srv.SenderChecker, srv.SenderCheckerContext
+	}
+	if l.SenderCheckerContext == nil && l.SenderChecker != nil {
+		check := l.SenderChecker
+		l.SenderCheckerContext = func(_ context.Context, peer *Peer, addr *mail.Address) error { return check(peer, addr) }
+	}
+	if l.RecipientChecker == nil && l.RecipientCheckerContext == nil {
+		l.RecipientChecker, l.RecipientCheckerContext = srv.RecipientChecker, srv.RecipientCheckerContext
+	}
+	if l.RecipientCheckerContext == nil && l.RecipientChecker != nil {
+		check := l.RecipientChecker
+		l.RecipientCheckerContext = func(_ context.Context, peer *Peer, addr *mail.Address) error { return check(peer, addr) }
+	}
+}
+
+// listen opens network listener for given (resolved) listener configuration
+// implicit TLS is started by the session, as the PROXY protocol header precedes the handshake
+func (l *Listener) listen() (net.Listener, error) {
+	if l.TLSMode != TLSNone && l.TLSConfig == nil {
+		return nil, errNoTLSConfig
+	}
+	return net.Listen(l.Network, l.Addr)
+}
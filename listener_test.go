@@ -0,0 +1,137 @@
+package gosmtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTLSConfig generates self-signed certificate for localhost
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// startTestListener starts serving given listener configuration on random local port
+func startTestListener(t *testing.T, srv *Server, l Listener) string {
+	l.Addr = "127.0.0.1:0"
+	resolved := srv.resolveListener(&l)
+	ln, err := resolved.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve(ln, resolved)
+	return ln.Addr().String()
+}
+
+func TestServer_Listeners(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Handler = dummyHandle
+	srv.RecipientChecker = dummyChecker
+	srv.TLSConfig = testTLSConfig(t)
+	srv.Auth(func(*Peer, []byte) (bool, error) { return true, nil })
+	defer srv.Close()
+
+	mx := startTestListener(t, srv, Listener{})
+	submission := startTestListener(t, srv, Listener{TLSMode: TLSStartTLS, RequireTLS: true, RequireAuth: true})
+	implicit := startTestListener(t, srv, Listener{TLSMode: TLSImplicit, RequireAuth: true})
+
+	// MX doesn't offer TLS nor require auth
+	c, err := smtp.Dial(mx)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Hello("localhost"))
+	ok, _ := c.Extension("STARTTLS")
+	assert.False(t, ok, "listener without TLS shouldn't offer STARTTLS")
+	_, _, err = testCmd(c.Text, 250, "MAIL FROM:<sender@localhost>")
+	assert.NoError(t, err, "listener without auth requirement should accept transaction")
+	c.Close()
+
+	// submission requires STARTTLS and authentication
+	c, err = smtp.Dial(submission)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Hello("localhost"))
+	ok, _ = c.Extension("STARTTLS")
+	assert.True(t, ok, "STARTTLS listener should offer STARTTLS")
+	err = c.Mail("sender@localhost")
+	assert.Error(t, err, "STARTTLS listener requiring TLS should reject plain text transaction")
+	assert.NoError(t, c.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+	err = c.Mail("sender@localhost")
+	assert.Error(t, err, "listener requiring authentication should reject unauthenticated transaction")
+	c.Close()
+
+	// implicit TLS
+	conn, err := tls.Dial("tcp", implicit, &tls.Config{InsecureSkipVerify: true})
+	assert.NoError(t, err, "implicit TLS listener should negotiate TLS")
+	c, err = smtp.NewClient(conn, "localhost")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Hello("localhost"))
+	ok, _ = c.Extension("STARTTLS")
+	assert.False(t, ok, "implicit TLS listener shouldn't offer STARTTLS")
+	ok, _ = c.Extension("AUTH")
+	assert.True(t, ok, "implicit TLS listener should offer AUTH")
+	c.Close()
+}
+
+func TestServer_ListenerCheckers(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.ConnectionChecker = func(peer *Peer) error { return nil }
+	defer srv.Close()
+
+	addr := startTestListener(t, srv, Listener{
+		ConnectionChecker: func(peer *Peer) error { return errors.New("go away") },
+	})
+	conn, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, msg, err := conn.ReadResponse(220)
+	assert.Error(t, err, "connection rejected by listener checker should be greeted by 554")
+	assert.Equal(t, "go away", msg)
+	_, _, err = testCmd(conn, 250, "HELO localhost")
+	assert.Error(t, err, "rejected connection should only accept QUIT")
+	_, _, err = testCmd(conn, 221, "QUIT")
+	assert.NoError(t, err)
+}
+
+func TestListener_listen(t *testing.T) {
+	l := &Listener{Network: "tcp", Addr: "127.0.0.1:0", TLSMode: TLSImplicit}
+	_, err := l.listen()
+	assert.Equal(t, errNoTLSConfig, err, "TLS listener without configuration shouldn't start")
+
+	l.TLSConfig = testTLSConfig(t)
+	ln, err := l.listen()
+	assert.NoError(t, err)
+	_, ok := ln.Addr().(*net.TCPAddr)
+	assert.True(t, ok)
+	ln.Close()
+}
@@ -0,0 +1,30 @@
+package gosmtp
+
+/*
+RFC 2033, Local Mail Transfer Protocol
+
+	The LMTP protocol is identical to the SMTP protocol SMTP [SMTP] [HOST-
+	REQ] with its service extensions ESMTP [ESMTP], except as modified by
+	this document.
+
+	After the final ".", the server returns one reply for each previously
+	successful RCPT command in the mail transaction, in the order that the
+	RCPT commands were issued.  Even if there were multiple successful RCPT
+	commands giving the same forward-path, there must be one reply for each
+	successful RCPT command.
+
+LHLO replaces HELO and EHLO, which are not accepted, and MAIL before LHLO is rejected.
+LMTP is enabled by Server.LMTP or Listener.LMTP, usually on Unix socket or local address, as it
+MUST NOT be used on TCP port 25. Per recipient replies come from Server.RecipientHandler, other
+handlers reply the same for all the recipients.
+*/
+
+// handleLhlo greets the LMTP client, LHLO isn't accepted in SMTP
+func handleLhlo(s *session, cmd *command) {
+	if !s.listener.LMTP {
+		s.Out(Codes.FailUnrecognizedCmd)
+		s.badCommandsCount++
+		return
+	}
+	s.ehlo(cmd, LMTP)
+}
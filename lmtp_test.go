@@ -0,0 +1,83 @@
+package gosmtp
+
+import (
+	"context"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_LMTP(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.RecipientHandler = func(ctx context.Context, peer *Peer, env *Envelope) (string, []error) {
+		errs := make([]error, len(env.MailTo))
+		for i, rcpt := range env.MailTo {
+			if rcpt.Address == "full@localhost" {
+				errs[i] = ErrorRecipientsMailboxFull
+			}
+		}
+		return "lmtp-id", errs
+	}
+	defer srv.Close()
+
+	// LMTP on Unix socket
+	l := srv.resolveListener(&Listener{Network: "unix", Addr: filepath.Join(t.TempDir(), "lmtp.sock"), LMTP: true})
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve(ln, l)
+
+	c, err := textproto.Dial("unix", l.Addr)
+	assert.NoError(t, err)
+	defer c.Close()
+	_, msg, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "LMTP")
+
+	_, _, err = testCmd(c, 554, "EHLO localhost")
+	assert.NoError(t, err, "EHLO isn't LMTP command")
+	_, _, err = testCmd(c, 503, "MAIL FROM:<a@localhost>")
+	assert.NoError(t, err, "MAIL has to follow LHLO")
+	_, _, err = testCmd(c, 250, "LHLO localhost")
+	assert.NoError(t, err)
+
+	// one reply per recipient after DATA
+	for _, cmd := range []string{"MAIL FROM:<a@localhost>", "RCPT TO:<b@localhost>", "RCPT TO:<full@localhost>", "RCPT TO:<b@localhost>"} {
+		_, _, err = testCmd(c, 250, cmd)
+		assert.NoError(t, err)
+	}
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, msg, err = testCmd(c, 250, "Subject: lmtp\r\n.")
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "lmtp-id")
+	_, _, err = c.ReadResponse(552)
+	assert.NoError(t, err)
+	_, _, err = c.ReadResponse(250)
+	assert.NoError(t, err)
+
+	// and after BDAT LAST
+	for _, cmd := range []string{"MAIL FROM:<a@localhost>", "RCPT TO:<full@localhost>", "RCPT TO:<b@localhost>"} {
+		_, _, err = testCmd(c, 250, cmd)
+		assert.NoError(t, err)
+	}
+	_, _, err = testCmd(c, 552, "BDAT 15 LAST\r\nSubject: lmtp")
+	assert.NoError(t, err)
+	_, _, err = c.ReadResponse(250)
+	assert.NoError(t, err)
+}
+
+func TestSession_LHLO(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 554, "LHLO localhost")
+	assert.NoError(t, err, "LHLO isn't SMTP command")
+}
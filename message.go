@@ -0,0 +1,269 @@
+package gosmtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"time"
+)
+
+// errStreamClosed is returned to writes once the StreamHandler returned without reading the whole message
+var errStreamClosed = errors.New("stream handler closed the message")
+
+// errTransactionReset is returned to StreamHandler when the transaction is reset before the message is complete
+var errTransactionReset = errors.New("transaction reset")
+
+// messageStream passes message data to the StreamHandler running in background
+type messageStream struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	cancel context.CancelFunc
+	id     string
+	err    error
+}
+
+// beginMessage prepares the headers added by the server and starts the StreamHandler, if it's set
+// it has to be called after the envelope is ready for data, the data are then written to messageWriter
+func (s *session) beginMessage() {
+	// add received header
+	/*
+		When forwarding a message into or out of the Internet environment, a
+		gateway MUST prepend a Received: line, but it MUST NOT alter in any
+		way a Received: line that is already in the header section.
+	*/
+	s.envelope.headers["Received"] = string(s.ReceivedHeader())
+
+	// add Message-ID, is user is aut
+	if s.peer.Authenticated {
+		s.envelope.headers["Message-ID"] = fmt.Sprintf("Message-ID: <%d.%s@%s>\r\n", time.Now().Unix(), s.id, s.peer.ServerName)
+	}
+
+	s.body = &eightBitWriter{w: s.envelope}
+	if s.srv.StreamHandler == nil {
+		return
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.listener.Limits.MsgInput > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, s.listener.Limits.MsgInput)
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
+	}
+	pr, pw := io.Pipe()
+	st := &messageStream{pw: pw, done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(st.done)
+		st.id, st.err = s.srv.StreamHandler(ctx, s.peer, s.envelope, pr)
+		// unblock the session if the handler didn't read the whole message
+		pr.CloseWithError(errStreamClosed)
+	}()
+	s.stream = st
+	s.body.w = pw
+
+	// the stream doesn't go through Envelope.Close, the headers are prepended to the data
+	for _, key := range []string{"Received", "Message-ID"} {
+		if header, ok := s.envelope.headers[key]; ok {
+			io.WriteString(pw, header)
+		}
+	}
+}
+
+// messageWriter returns where the message data should be written, the envelope or the stream
+func (s *session) messageWriter() io.Writer {
+	return s.body
+}
+
+// endMessage finishes successfully received message and hands it to the handler
+func (s *session) endMessage() (string, error) {
+	if s.stream == nil {
+		s.envelope.Close()
+		if s.srv.RecipientHandler != nil {
+			return s.deliverRecipients()
+		}
+		return s.handle()
+	}
+	st := s.stream
+	s.stream = nil
+	st.pw.Close()
+	<-st.done
+	st.cancel()
+	return st.id, st.err
+}
+
+// deliverMessage hands the received message off and replies, LMTP client gets one reply per recipient
+func (s *session) deliverMessage() {
+	s.envelope.EightBit = s.body.eightBit
+	if s.envelope.EightBit && s.envelope.BodyType.Is7Bit() && s.srv.EightBitData == EightBitReject {
+		/*
+			https://tools.ietf.org/html/rfc6152
+			the message declared as 7-bit contains 8-bit data
+		*/
+		s.discardMessage(errEightBitData)
+		replies := 1
+		if s.listener.LMTP {
+			replies = len(s.envelope.MailTo)
+		}
+		for i := 0; i < replies; i++ {
+			s.Out(Codes.FailEightBitData)
+		}
+		return
+	}
+
+	if !s.listener.LMTP {
+		id, err := s.endMessage()
+		s.replyMessage(id, err)
+		return
+	}
+
+	var id string
+	var errs []error
+	if s.stream == nil && s.srv.RecipientHandler != nil {
+		s.envelope.Close()
+		id, errs = s.recipientResults()
+	} else {
+		var err error
+		id, err = s.endMessage()
+		errs = make([]error, len(s.envelope.MailTo))
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	for _, err := range errs {
+		s.replyMessage(id, err)
+	}
+}
+
+// replyMessage sends reply to the message hand off
+func (s *session) replyMessage(id string, err error) {
+	if err != nil {
+		s.replyError(err, "451 temporary queue error")
+	} else {
+		s.Out(fmt.Sprintf("%v %s", Codes.SuccessMessageQueued, id))
+	}
+}
+
+// recipientResults calls RecipientHandler, wrong number of results is turned into temporary failure of all recipients
+func (s *session) recipientResults() (string, []error) {
+	id, errs := s.handleRecipients()
+	if len(errs) != len(s.envelope.MailTo) {
+		s.log.Printf("ERROR: recipient handler returned %d results for %d recipients", len(errs), len(s.envelope.MailTo))
+		err := errors.New("invalid number of recipient results")
+		errs = make([]error, len(s.envelope.MailTo))
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return id, errs
+}
+
+// deliverRecipients calls RecipientHandler and turns the results into single reply, see Server.RecipientHandler
+func (s *session) deliverRecipients() (string, error) {
+	id, errs := s.recipientResults()
+
+	var failed []RecipientResult
+	var temporary, permanent error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		result := recipientResult(s.envelope.MailTo[i], err)
+		failed = append(failed, result)
+		if result.Action == DSNActionFailed {
+			if permanent == nil {
+				permanent = err
+			}
+		} else if temporary == nil {
+			temporary = err
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		return id, nil
+	case len(failed) == len(errs) && temporary != nil:
+		return "", temporary
+	case len(failed) == len(errs):
+		return "", permanent
+	}
+
+	// accepted for some of the recipients, temporary failures are retried by DeferHandler, the rest is bounced
+	var deferred []*mail.Address
+	for i, result := range failed {
+		if result.Action == DSNActionDelayed {
+			if s.srv.DeferHandler != nil {
+				s.log.Printf("INFO: message %s deferred for %s: %s", id, result.Recipient.Address, result.DiagnosticCode)
+				deferred = append(deferred, result.Recipient)
+				continue
+			}
+			// nobody will try again, the failure is permanent
+			failed[i].Action = DSNActionFailed
+			failed[i].Status.Class = ClassPermanentFailure
+		}
+		s.log.Printf("INFO: message %s rejected for %s: %s", id, result.Recipient.Address, result.DiagnosticCode)
+	}
+	if len(deferred) > 0 {
+		s.srv.DeferHandler(s.peer, s.envelope, deferred)
+	}
+	if s.srv.DSNHandler == nil {
+		return id, nil
+	}
+	dsn, err := NewDSN(s.envelope, DSNReport{ReportingMTA: s.reportingMTA(), ArrivalDate: time.Now(), Results: failed})
+	if err != nil {
+		s.log.Printf("INFO: no DSN for message %s: %s", id, err)
+		return id, nil
+	}
+	s.srv.DSNHandler(s.peer, s.envelope, dsn)
+	return id, nil
+}
+
+// reportingMTA returns host name of the server for DSN, the machine host name if Server.Hostname isn't set
+func (s *session) reportingMTA() string {
+	if s.peer.ServerName != "" {
+		return s.peer.ServerName
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "localhost"
+}
+
+// recipientResult returns result of the failed recipient, 5xx Error is permanent failure, other errors
+// are temporary and the delivery is delayed, RFC 3464 requires class 5 status for failed action and 4 for delayed
+func recipientResult(rcpt *mail.Address, err error) RecipientResult {
+	result := RecipientResult{
+		Recipient: rcpt,
+		Action:    DSNActionDelayed,
+		Status:    EnhancedStatusCode{ClassTransientFailure, OtherOrUndefinedMailSystemStatus},
+	}
+	var smtpErr *Error
+	if errors.As(err, &smtpErr) {
+		result.DiagnosticCode = smtpErr.Error()
+		if smtpErr.EnhancedCode.SubjectDetailCode != "" {
+			result.Status.SubjectDetailCode = smtpErr.EnhancedCode.SubjectDetailCode
+		}
+		code := class(smtpErr.Code / 100)
+		if smtpErr.Code == 0 {
+			code = smtpErr.EnhancedCode.Class
+		}
+		if code == ClassPermanentFailure {
+			result.Action = DSNActionFailed
+			result.Status.Class = ClassPermanentFailure
+		}
+	}
+	return result
+}
+
+// discardMessage aborts the message being received, the StreamHandler gets err from the reader
+func (s *session) discardMessage(err error) {
+	if s.stream == nil {
+		return
+	}
+	st := s.stream
+	s.stream = nil
+	st.pw.CloseWithError(err)
+	<-st.done
+	st.cancel()
+}
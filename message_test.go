@@ -0,0 +1,139 @@
+package gosmtp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_StreamHandler(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Limits.MsgSize = 100
+	started := make(chan string, 1)
+	result := make(chan error, 1)
+	srv.StreamHandler = func(ctx context.Context, peer *Peer, env *Envelope, r io.Reader) (string, error) {
+		br := bufio.NewReader(r)
+		received, _ := br.ReadString('\n')
+		started <- received
+		rest, err := io.ReadAll(br)
+		result <- err
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(string(rest), "Subject: streamed\r\n") {
+			return "", NewError(554, ClassPermanentFailure, OtherOrUndefinedMediaError, "bad message")
+		}
+		return "stream-id", nil
+	}
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	for _, cmd := range []string{"EHLO localhost", "MAIL FROM:<a@localhost>", "RCPT TO:<b@localhost>"} {
+		_, _, err = testCmd(c, 250, cmd)
+		assert.NoError(t, err)
+	}
+
+	// handler gets the data before the message is complete
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	assert.NoError(t, c.PrintfLine("Subject: streamed"))
+	assert.True(t, strings.HasPrefix(<-started, "Received: "), "stream should start with Received header")
+	_, msg, err := testCmd(c, 250, "\r\nbody\r\n.")
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "stream-id")
+	assert.NoError(t, <-result)
+
+	// too big message is discarded, the handler gets the error
+	for _, cmd := range []string{"MAIL FROM:<a@localhost>", "RCPT TO:<b@localhost>"} {
+		_, _, err = testCmd(c, 250, cmd)
+		assert.NoError(t, err)
+	}
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 552, strings.Repeat("x", 200)+"\r\n.")
+	assert.NoError(t, err)
+	<-started
+	assert.Equal(t, errMessageTooBig, <-result)
+}
+
+func TestSession_RecipientHandler(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	full := NewError(552, ClassPermanentFailure, MailboxFull, "Mailbox full")
+	busy := NewError(450, ClassTransientFailure, OtherOrUndefinedMailboxStatus, "Mailbox busy")
+	results := map[string]error{"full@localhost": full, "busy@localhost": busy, "error@localhost": errors.New("boom")}
+	srv.RecipientHandler = func(ctx context.Context, peer *Peer, env *Envelope) (string, []error) {
+		errs := make([]error, len(env.MailTo))
+		for i, rcpt := range env.MailTo {
+			errs[i] = results[rcpt.Address]
+		}
+		return "multi-id", errs
+	}
+	dsns := make(chan string, 1)
+	srv.DSNHandler = func(peer *Peer, env *Envelope, dsn []byte) {
+		dsns <- string(dsn)
+	}
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	send := func(code int, rcpts ...string) string {
+		_, _, err := testCmd(c, 250, "MAIL FROM:<a@localhost>")
+		assert.NoError(t, err)
+		for _, rcpt := range rcpts {
+			_, _, err = testCmd(c, 250, "RCPT TO:<"+rcpt+">")
+			assert.NoError(t, err)
+		}
+		_, _, err = testCmd(c, 354, "DATA")
+		assert.NoError(t, err)
+		_, msg, err := testCmd(c, code, "Subject: multi\r\n.")
+		assert.NoError(t, err)
+		return msg
+	}
+
+	assert.Contains(t, send(250, "ok@localhost", "ok2@localhost"), "multi-id")
+
+	// accepted for one of the recipients, the failed one gets DSN
+	assert.Contains(t, send(250, "ok@localhost", "full@localhost"), "multi-id")
+	dsn := <-dsns
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; full@localhost\r\nAction: failed\r\nStatus: 5.2.2\r\n")
+	assert.NotContains(t, dsn, "Final-Recipient: rfc822; ok@localhost")
+
+	// temporary failure isn't retried without DeferHandler, so it's permanent
+	assert.Contains(t, send(250, "ok@localhost", "busy@localhost"), "multi-id")
+	dsn = <-dsns
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; busy@localhost\r\nAction: failed\r\nStatus: 5.2.0\r\n")
+
+	// temporary failures are kept for retry and reported as delayed
+	deferred := make(chan []*mail.Address, 1)
+	srv.DeferHandler = func(peer *Peer, env *Envelope, rcpts []*mail.Address) {
+		deferred <- rcpts
+	}
+	assert.Contains(t, send(250, "ok@localhost", "busy@localhost", "error@localhost", "full@localhost"), "multi-id")
+	rcpts := <-deferred
+	if assert.Len(t, rcpts, 2) {
+		assert.Equal(t, "busy@localhost", rcpts[0].Address)
+		assert.Equal(t, "error@localhost", rcpts[1].Address)
+	}
+	dsn = <-dsns
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; busy@localhost\r\nAction: delayed\r\nStatus: 4.2.0\r\n")
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; error@localhost\r\nAction: delayed\r\nStatus: 4.3.0\r\n")
+	assert.Contains(t, dsn, "Final-Recipient: rfc822; full@localhost\r\nAction: failed\r\nStatus: 5.2.2\r\n")
+
+	// failed for all, temporary failure is preferred
+	assert.Equal(t, "4.2.0 Mailbox busy", send(450, "full@localhost", "busy@localhost"))
+	assert.Equal(t, "5.2.2 Mailbox full", send(552, "full@localhost"))
+}
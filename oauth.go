@@ -0,0 +1,176 @@
+package gosmtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+/*
+RFC 7628, A Set of Simple Authentication and Security Layer (SASL) Mechanisms for OAuth
+
+	kvsep          = %x01
+	client-resp    = (gs2-header kvsep *kvpair kvsep) / kvsep
+	kvpair         = key "=" value kvsep
+	auth-value     = "Bearer" 1*SP b64token
+
+	If the client's request failed, the server returns a JSON error message
+	in a challenge, the client responds with a single kvsep as a dummy response
+	and the server fails the authentication.
+
+XOAUTH2 is the older Google variant, its initial response is
+
+	"user=" user kvsep "auth=Bearer " token kvsep kvsep
+
+and the error challenge is answered by an empty response.
+*/
+
+// TokenValidator validates OAuth bearer token of the peer, peer.Username is the user named by the client,
+// empty if OAUTHBEARER client didn't send authzid, the validator may set it from the token.
+// Return false or OAuthError for invalid token, the client gets the JSON error, other errors abort the session.
+type TokenValidator func(ctx context.Context, peer *Peer, token string) (bool, error)
+
+// OAuthError is the JSON error sent to the client if the token is rejected, see RFC 7628 section 3.2.2
+type OAuthError struct {
+	Status              string `json:"status"`                         // e.g. invalid_token, insufficient_scope
+	Scope               string `json:"scope,omitempty"`                // scope needed by the server
+	OpenIDConfiguration string `json:"openid-configuration,omitempty"` // URL of the discovery document
+	Schemes             string `json:"schemes,omitempty"`              // authentication schemes, used by XOAUTH2
+}
+
+func (e *OAuthError) Error() string {
+	return "oauth: " + e.Status
+}
+
+// OAuthBearerMechanism returns OAUTHBEARER mechanism, tokens are checked by validate
+func OAuthBearerMechanism(validate TokenValidator) SASLMechanism {
+	return &oauthMechanism{name: "OAUTHBEARER", validate: validate}
+}
+
+// XOAuth2Mechanism returns XOAUTH2 mechanism, tokens are checked by validate
+func XOAuth2Mechanism(validate TokenValidator) SASLMechanism {
+	return &oauthMechanism{name: "XOAUTH2", validate: validate}
+}
+
+type oauthMechanism struct {
+	name     string
+	validate TokenValidator
+}
+
+func (m *oauthMechanism) Name() string {
+	return m.name
+}
+
+func (m *oauthMechanism) Start(peer *Peer) SASLServer {
+	return &oauthServer{mech: m, peer: peer}
+}
+
+type oauthServer struct {
+	mech   *oauthMechanism
+	peer   *Peer
+	failed bool // the error challenge was sent
+}
+
+func (o *oauthServer) Next(ctx context.Context, response []byte) ([]byte, bool, error) {
+	switch {
+	case o.failed:
+		// the client acknowledges the error
+		return nil, false, ErrAuthFailed
+	case response == nil:
+		return []byte{}, false, nil
+	}
+
+	var user, token string
+	var err error
+	if o.mech.name == "XOAUTH2" {
+		user, token, err = parseXOAuth2(response)
+	} else {
+		user, token, err = parseOAuthBearer(response)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	o.peer.Username = user
+
+	ok, err := o.mech.validate(ctx, o.peer, token)
+	var oauthErr *OAuthError
+	switch {
+	case errors.As(err, &oauthErr):
+	case err != nil:
+		return nil, false, err
+	case ok:
+		return nil, true, nil
+	default:
+		oauthErr = &OAuthError{Status: "invalid_token"}
+	}
+	if o.mech.name == "XOAUTH2" && oauthErr.Status == "invalid_token" {
+		// Google sends HTTP status, 401 for invalid tokens
+		oauthErr = &OAuthError{Status: "401", Schemes: "bearer", Scope: oauthErr.Scope}
+	}
+	o.failed = true
+	challenge, err := json.Marshal(oauthErr)
+	if err != nil {
+		return nil, false, err
+	}
+	return challenge, false, nil
+}
+
+func (o *oauthServer) rejected() bool {
+	return o.failed
+}
+
+// parseOAuthBearer parses OAUTHBEARER client response, returns authzid and the bearer token
+func parseOAuthBearer(response []byte) (string, string, error) {
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := bytes.SplitN(response, []byte{','}, 3)
+	if len(parts) != 3 || (string(parts[0]) != "n" && string(parts[0]) != "y") {
+		return "", "", ErrAuthMalformed
+	}
+	var user string
+	if len(parts[1]) > 0 {
+		if !bytes.HasPrefix(parts[1], []byte("a=")) {
+			return "", "", ErrAuthMalformed
+		}
+		var err error
+		if user, err = decodeSASLName(string(parts[1][2:])); err != nil {
+			return "", "", ErrAuthMalformed
+		}
+	}
+	token, err := parseOAuthPairs(parts[2])
+	return user, token, err
+}
+
+// parseXOAuth2 parses XOAUTH2 client response, returns the user and the bearer token
+func parseXOAuth2(response []byte) (string, string, error) {
+	i := bytes.IndexByte(response, 1)
+	if i < 0 || !bytes.HasPrefix(response, []byte("user=")) {
+		return "", "", ErrAuthMalformed
+	}
+	token, err := parseOAuthPairs(response[i:])
+	return string(response[5:i]), token, err
+}
+
+// parseOAuthPairs returns bearer token from kvsep *kvpair kvsep
+func parseOAuthPairs(data []byte) (string, error) {
+	if len(data) < 3 || !bytes.HasPrefix(data, []byte{1}) || !bytes.HasSuffix(data, []byte{1, 1}) {
+		return "", ErrAuthMalformed
+	}
+	for _, pair := range strings.Split(string(data[1:len(data)-2]), "\x01") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", ErrAuthMalformed
+		}
+		if key != "auth" {
+			// host and port are informational
+			continue
+		}
+		scheme, token, ok := strings.Cut(value, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			return "", ErrAuthMalformed
+		}
+		return strings.TrimSpace(token), nil
+	}
+	return "", ErrAuthMalformed
+}
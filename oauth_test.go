@@ -0,0 +1,94 @@
+package gosmtp
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOAuthBearer(t *testing.T) {
+	user, token, err := parseOAuthBearer([]byte("n,a=user@example.com,\x01host=server.example.com\x01port=587\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user@example.com", user)
+	assert.Equal(t, "vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==", token)
+
+	user, token, err = parseXOAuth2([]byte("user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg\x01\x01"))
+	assert.NoError(t, err)
+	assert.Equal(t, "someuser@example.com", user)
+	assert.Equal(t, "ya29.vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg", token)
+
+	for _, response := range []string{
+		"n,,\x01\x01",
+		"x,,\x01auth=Bearer token\x01\x01",
+		"n,user,\x01auth=Bearer token\x01\x01",
+		"n,,\x01auth=Basic token\x01\x01",
+		"n,,\x01auth=Bearer token\x01",
+	} {
+		_, _, err := parseOAuthBearer([]byte(response))
+		assert.Equal(t, ErrAuthMalformed, err, response)
+	}
+}
+
+func TestServer_AuthOAuth(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	validate := func(ctx context.Context, peer *Peer, token string) (bool, error) {
+		switch token {
+		case "scope":
+			return false, &OAuthError{Status: "insufficient_scope", Scope: "mail"}
+		case "valid":
+			if peer.Username == "" {
+				peer.Username = "user@example.com"
+			}
+			return peer.Username == "user@example.com", nil
+		}
+		return false, nil
+	}
+	assert.NoError(t, srv.Auth(nil, OAuthBearerMechanism(validate), XOAuth2Mechanism(validate)))
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	c := testAuthClient(t, srv)
+	defer c.Close()
+	ok, mechs := c.Extension("AUTH")
+	assert.True(t, ok)
+	assert.Equal(t, "OAUTHBEARER XOAUTH2", mechs)
+
+	// rejected token is answered by JSON error
+	msg, err := testAuthCmd(c.Text, 334, "AUTH OAUTHBEARER "+b64("n,,\x01auth=Bearer invalid\x01\x01"))
+	assert.NoError(t, err)
+	assert.Equal(t, b64(`{"status":"invalid_token"}`), msg)
+	_, err = testAuthCmd(c.Text, 535, b64("\x01"))
+	assert.NoError(t, err)
+
+	msg, err = testAuthCmd(c.Text, 334, "AUTH OAUTHBEARER "+b64("n,,\x01auth=Bearer scope\x01\x01"))
+	assert.NoError(t, err)
+	assert.Equal(t, b64(`{"status":"insufficient_scope","scope":"mail"}`), msg)
+	_, err = testAuthCmd(c.Text, 535, b64("\x01"))
+	assert.NoError(t, err)
+
+	msg, err = testAuthCmd(c.Text, 334, "AUTH XOAUTH2 "+b64("user=user@example.com\x01auth=Bearer invalid\x01\x01"))
+	assert.NoError(t, err)
+	assert.Equal(t, b64(`{"status":"401","schemes":"bearer"}`), msg)
+	_, err = testAuthCmd(c.Text, 535, "")
+	assert.NoError(t, err)
+
+	// token of other user
+	_, err = testAuthCmd(c.Text, 334, "AUTH XOAUTH2 "+b64("user=other@example.com\x01auth=Bearer valid\x01\x01"))
+	assert.NoError(t, err)
+	_, err = testAuthCmd(c.Text, 535, "")
+	assert.NoError(t, err)
+
+	_, err = testAuthCmd(c.Text, 235, "AUTH OAUTHBEARER "+b64("n,,\x01auth=Bearer valid\x01\x01"))
+	assert.NoError(t, err)
+	c.Close()
+
+	c = testAuthClient(t, srv)
+	_, err = testAuthCmd(c.Text, 235, "AUTH XOAUTH2 "+b64("user=user@example.com\x01auth=Bearer valid\x01\x01"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,349 @@
+package gosmtp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+RFC 5321 section 4.1.2, paths of MAIL and RCPT commands
+
+	Reverse-path   = Path / "<>"
+	Forward-path   = Path
+	Path           = "<" [ A-d-l ":" ] Mailbox ">"
+	A-d-l          = At-domain *( "," At-domain )
+	At-domain      = "@" Domain
+	Mailbox        = Local-part "@" ( Domain / address-literal )
+	Local-part     = Dot-string / Quoted-string
+	Mail-parameters  = esmtp-param *(SP esmtp-param)
+	esmtp-param    = esmtp-keyword ["=" esmtp-value]
+	esmtp-keyword  = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+	esmtp-value    = 1*(%d33-60 / %d62-126)
+
+The source route (A-d-l) is deprecated, servers SHOULD ignore it (section 4.1.1.3 and appendix C).
+*/
+
+const (
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+	maxPathLength      = 256
+)
+
+var (
+	errInvalidPath      = errors.New("invalid path")
+	errInvalidParameter = errors.New("invalid ESMTP parameter")
+	errLocalPartTooLong = errors.New("local part too long")
+	errDomainTooLong    = errors.New("domain too long")
+	errPathTooLong      = errors.New("path too long")
+)
+
+// pathErrorReply returns reply to the error of path parser, invalid is used for syntax errors
+func pathErrorReply(err error, invalid string) string {
+	switch err {
+	case errLocalPartTooLong:
+		return Codes.FailLocalPartTooLong
+	case errDomainTooLong:
+		return Codes.FailDomainTooLong
+	case errPathTooLong:
+		return Codes.FailPathTooLong
+	case errInvalidParameter:
+		return Codes.FailInvalidExtension
+	case errNonASCIIAddress:
+		return Codes.FailNonASCIIAddress
+	default:
+		return invalid
+	}
+}
+
+// pathParser parses path and parameters of MAIL and RCPT commands
+type pathParser struct {
+	s   string
+	pos int
+}
+
+// parseReversePath parses argument of MAIL command following 'FROM:', the mailbox is empty for the null path
+func parseReversePath(s string) (mailbox string, params map[string]string, err error) {
+	p := &pathParser{s: strings.TrimLeft(s, " ")}
+	if strings.HasPrefix(p.s, "<>") {
+		p.pos = 2
+		params, err = p.parameters()
+		return "", params, err
+	}
+	return p.path(false)
+}
+
+// parseForwardPath parses argument of RCPT command following 'TO:'
+// the special <Postmaster> recipient without domain is returned as 'postmaster'
+func parseForwardPath(s string) (mailbox string, params map[string]string, err error) {
+	p := &pathParser{s: strings.TrimLeft(s, " ")}
+	return p.path(true)
+}
+
+// parseMailbox parses Mailbox without angle brackets, e.g. the value of AUTH parameter of MAIL command
+func parseMailbox(s string) (string, error) {
+	if len(s) > maxPathLength {
+		return "", errPathTooLong
+	}
+	p := &pathParser{s: s}
+	local, err := p.localPart()
+	if err != nil {
+		return "", err
+	}
+	if len(local) > maxLocalPartLength {
+		return "", errLocalPartTooLong
+	}
+	if !p.consume('@') {
+		return "", errInvalidPath
+	}
+	domain, err := p.domainOrLiteral()
+	if err != nil {
+		return "", err
+	}
+	if p.pos != len(p.s) {
+		return "", errInvalidPath
+	}
+	return local + "@" + domain, nil
+}
+
+// path parses the whole path followed by the parameters
+func (p *pathParser) path(postmaster bool) (string, map[string]string, error) {
+	if !p.consume('<') {
+		return "", nil, errInvalidPath
+	}
+	if p.peek() == '@' {
+		if err := p.sourceRoute(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	start := p.pos
+	local, err := p.localPart()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(local) > maxLocalPartLength {
+		return "", nil, errLocalPartTooLong
+	}
+
+	var mailbox string
+	switch {
+	case postmaster && p.peek() == '>' && strings.EqualFold(local, "postmaster"):
+		mailbox = "postmaster"
+	case p.consume('@'):
+		domain, err := p.domainOrLiteral()
+		if err != nil {
+			return "", nil, err
+		}
+		mailbox = local + "@" + domain
+	default:
+		return "", nil, errInvalidPath
+	}
+	if p.pos-start > maxPathLength {
+		return "", nil, errPathTooLong
+	}
+	if !p.consume('>') {
+		return "", nil, errInvalidPath
+	}
+
+	params, err := p.parameters()
+	if err != nil {
+		return "", nil, err
+	}
+	return mailbox, params, nil
+}
+
+// sourceRoute skips the deprecated list of at-domains
+func (p *pathParser) sourceRoute() error {
+	for {
+		if !p.consume('@') {
+			return errInvalidPath
+		}
+		if _, err := p.domain(); err != nil {
+			return err
+		}
+		if p.consume(':') {
+			return nil
+		}
+		if !p.consume(',') {
+			return errInvalidPath
+		}
+	}
+}
+
+// localPart parses dot-string or quoted string, the quoted string is returned as written including the quotes
+func (p *pathParser) localPart() (string, error) {
+	if p.peek() == '"' {
+		return p.quotedString()
+	}
+	start := p.pos
+	// UTF-8 is validated by normalizeMailbox
+	for p.pos < len(p.s) && (isAtext(p.s[p.pos]) || p.s[p.pos] == '.' || p.s[p.pos] >= utf8.RuneSelf) {
+		p.pos++
+	}
+	local := p.s[start:p.pos]
+	if local == "" || local[0] == '.' || local[len(local)-1] == '.' || strings.Contains(local, "..") {
+		return "", errInvalidPath
+	}
+	return local, nil
+}
+
+// quotedString parses quoted string and returns it as written, unquoting it would change the mailbox
+func (p *pathParser) quotedString() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '"':
+			return p.s[start:p.pos], nil
+		case c == '\\':
+			// quoted-pair = %d92 %d32-126
+			if p.pos >= len(p.s) || p.s[p.pos] < 32 || p.s[p.pos] > 126 {
+				return "", errInvalidPath
+			}
+			p.pos++
+		case (c >= 32 && c <= 126) || c >= utf8.RuneSelf:
+			// qtextSMTP = %d32-33 / %d35-91 / %d93-126 / UTF8-non-ascii
+		default:
+			return "", errInvalidPath
+		}
+	}
+	return "", errInvalidPath
+}
+
+// domainOrLiteral parses domain or address literal
+func (p *pathParser) domainOrLiteral() (string, error) {
+	if p.peek() == '[' {
+		return p.addressLiteral()
+	}
+	return p.domain()
+}
+
+// domain parses domain name, sub-domain *("." sub-domain)
+func (p *pathParser) domain() (string, error) {
+	start := p.pos
+	// U-labels are validated by normalizeMailbox
+	for p.pos < len(p.s) && (isLetDig(p.s[p.pos]) || p.s[p.pos] == '-' || p.s[p.pos] == '.' || p.s[p.pos] >= utf8.RuneSelf) {
+		p.pos++
+	}
+	domain := p.s[start:p.pos]
+	if len(domain) > maxDomainLength {
+		return "", errDomainTooLong
+	}
+	for _, label := range strings.Split(domain, ".") {
+		// sub-domain = Let-dig [Ldh-str]
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", errInvalidPath
+		}
+	}
+	return domain, nil
+}
+
+// addressLiteral parses IPv4, IPv6 or general address literal in brackets
+func (p *pathParser) addressLiteral() (string, error) {
+	end := strings.IndexByte(p.s[p.pos:], ']')
+	if end < 0 {
+		return "", errInvalidPath
+	}
+	literal := p.s[p.pos : p.pos+end+1]
+	content := literal[1 : len(literal)-1]
+	p.pos += end + 1
+
+	if ip := net.ParseIP(content); ip != nil && ip.To4() != nil && !strings.Contains(content, ":") {
+		return literal, nil
+	}
+	if len(content) > 5 && strings.EqualFold(content[:5], "IPv6:") {
+		if ip := net.ParseIP(content[5:]); ip != nil && strings.Contains(content[5:], ":") {
+			return literal, nil
+		}
+		return "", errInvalidPath
+	}
+	// General-address-literal = Standardized-tag ":" 1*dcontent
+	if i := strings.IndexByte(content, ':'); i > 0 && i < len(content)-1 {
+		for j := 0; j < i; j++ {
+			if !isLetDig(content[j]) && content[j] != '-' {
+				return "", errInvalidPath
+			}
+		}
+		for j := i + 1; j < len(content); j++ {
+			// dcontent = %d33-90 / %d94-126
+			if c := content[j]; c < 33 || c > 126 || (c >= 91 && c <= 93) {
+				return "", errInvalidPath
+			}
+		}
+		return literal, nil
+	}
+	return "", errInvalidPath
+}
+
+// parameters parses space separated ESMTP parameters following the path
+// keywords are returned upper case, parameters without value have empty value
+func (p *pathParser) parameters() (map[string]string, error) {
+	rest := p.s[p.pos:]
+	params := make(map[string]string)
+	if rest == "" {
+		return params, nil
+	}
+	if rest[0] != ' ' {
+		return nil, errInvalidPath
+	}
+	for _, param := range strings.Fields(rest) {
+		kv := strings.SplitN(param, "=", 2)
+		keyword := strings.ToUpper(kv[0])
+		if keyword == "" || !isLetDig(keyword[0]) {
+			return nil, errInvalidParameter
+		}
+		for i := 1; i < len(keyword); i++ {
+			if !isLetDig(keyword[i]) && keyword[i] != '-' {
+				return nil, errInvalidParameter
+			}
+		}
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+			if value == "" {
+				return nil, errInvalidParameter
+			}
+			for i := 0; i < len(value); i++ {
+				if value[i] < 33 || value[i] > 126 || value[i] == '=' {
+					return nil, errInvalidParameter
+				}
+			}
+		}
+		if _, ok := params[keyword]; ok {
+			return nil, errInvalidParameter
+		}
+		params[keyword] = value
+	}
+	return params, nil
+}
+
+// peek returns current character or 0 at the end of input
+func (p *pathParser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// consume skips the current character if it's c
+func (p *pathParser) consume(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// isLetDig checks for Let-dig = ALPHA / DIGIT
+func isLetDig(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isAtext checks for atext characters of RFC 5322
+func isAtext(c byte) bool {
+	return isLetDig(c) || strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
@@ -0,0 +1,91 @@
+package gosmtp
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReversePath(t *testing.T) {
+	tests := []struct {
+		arg     string
+		mailbox string
+		params  map[string]string
+		err     error
+	}{
+		{"<>", "", map[string]string{}, nil},
+		{"<> BODY=8BITMIME", "", map[string]string{"BODY": "8BITMIME"}, nil},
+		{"<John.Doe@Example.com>", "John.Doe@Example.com", map[string]string{}, nil},
+		{" <user@example.com>", "user@example.com", map[string]string{}, nil},
+		{"<user@example.com> size=100 SMTPUTF8", "user@example.com", map[string]string{"SIZE": "100", "SMTPUTF8": ""}, nil},
+		{"<\"john doe\"@example.com>", "\"john doe\"@example.com", map[string]string{}, nil},
+		{"<\"a\\\"b\"@example.com>", "\"a\\\"b\"@example.com", map[string]string{}, nil},
+		{"<\"a@b\"@example.com>", "\"a@b\"@example.com", map[string]string{}, nil},
+		{"<@relay.example.com,@other.example.com:user@example.com>", "user@example.com", map[string]string{}, nil},
+		{"<user@[192.0.2.1]>", "user@[192.0.2.1]", map[string]string{}, nil},
+		{"<user@[IPv6:2001:db8::1]>", "user@[IPv6:2001:db8::1]", map[string]string{}, nil},
+		{"<user@[x-tag:content]>", "user@[x-tag:content]", map[string]string{}, nil},
+		{"user@example.com", "", nil, errInvalidPath},
+		{"<user@example.com", "", nil, errInvalidPath},
+		{"<user>", "", nil, errInvalidPath},
+		{"<postmaster>", "", nil, errInvalidPath},
+		{"<.user@example.com>", "", nil, errInvalidPath},
+		{"<us..er@example.com>", "", nil, errInvalidPath},
+		{"<user@-example.com>", "", nil, errInvalidPath},
+		{"<user@example..com>", "", nil, errInvalidPath},
+		{"<user@[300.0.0.1]>", "", nil, errInvalidPath},
+		{"<user@[IPv6:192.0.2.1]>", "", nil, errInvalidPath},
+		{"<\"unterminated@example.com>", "", nil, errInvalidPath},
+		{"<user@example.com>SIZE=1", "", nil, errInvalidPath},
+		{"<user@example.com> SIZE=", "", nil, errInvalidParameter},
+		{"<user@example.com> -SIZE=1", "", nil, errInvalidParameter},
+		{"<user@example.com> SIZE=1 size=2", "", nil, errInvalidParameter},
+		{"<" + strings.Repeat("a", 65) + "@example.com>", "", nil, errLocalPartTooLong},
+		{"<\"" + strings.Repeat("a", 63) + "\"@example.com>", "", nil, errLocalPartTooLong},
+		{"<user@" + strings.Repeat("a.", 128) + "com>", "", nil, errDomainTooLong},
+		{"<" + strings.Repeat("a", 64) + "@" + strings.Repeat("a.", 96) + "com>", "", nil, errPathTooLong},
+	}
+	for _, test := range tests {
+		mailbox, params, err := parseReversePath(test.arg)
+		assert.Equal(t, test.err, err, test.arg)
+		assert.Equal(t, test.mailbox, mailbox, test.arg)
+		assert.Equal(t, test.params, params, test.arg)
+	}
+}
+
+func TestParseForwardPath(t *testing.T) {
+	mailbox, _, err := parseForwardPath("<Postmaster>")
+	assert.NoError(t, err)
+	assert.Equal(t, "postmaster", mailbox)
+
+	mailbox, _, err = parseForwardPath("<Postmaster@example.com>")
+	assert.NoError(t, err)
+	assert.Equal(t, "Postmaster@example.com", mailbox)
+
+	_, _, err = parseForwardPath("<>")
+	assert.Equal(t, errInvalidPath, err, "null path is not allowed in RCPT")
+}
+
+func TestSession_MailRcptPaths(t *testing.T) {
+	c := textproto.NewConn(testDial(testServer))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+
+	_, _, err = testCmd(c, 501, "MAIL FROM:user@localhost")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 555, "MAIL FROM:<user@localhost> UNKNOWN=1")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "MAIL FROM:<>")
+	assert.NoError(t, err, "null sender should be accepted")
+	_, _, err = testCmd(c, 250, "RCPT TO:<@relay.localhost:\"John Doe\"@localhost>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 501, "RCPT TO:<>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RCPT TO:<postmaster>")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,235 @@
+package gosmtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+HAProxy PROXY protocol, https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+The PROXY protocol header is sent by the proxy right after the connection is established
+and before any data from the client. It carries the original source and destination
+addresses of the client connection, so the server sees the real client instead of the
+proxy. Version 1 is human readable single line, version 2 is binary and can carry
+additional information in TLVs, e.g. about the TLS connection terminated at the proxy.
+*/
+
+const (
+	proxyV1MaxLength = 107 // maximum length of v1 header including CRLF
+	proxyV2HeaderLen = 16  // signature, version and command, family and length
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamTCP4 = 0x11
+	proxyV2FamUDP4 = 0x12
+	proxyV2FamTCP6 = 0x21
+	proxyV2FamUDP6 = 0x22
+
+	proxyV2TypeSSL       = 0x20
+	proxyV2SubtypeVer    = 0x21
+	proxyV2SubtypeCN     = 0x22
+	proxyV2SubtypeCipher = 0x23
+	proxyV2SubtypeSigAlg = 0x24
+	proxyV2SubtypeKeyAlg = 0x25
+
+	proxyV2ClientSSL      = 0x01
+	proxyV2ClientCertConn = 0x02
+	proxyV2ClientCertSess = 0x04
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errProxyHeader is returned when the PROXY protocol header is missing or malformed
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ProxyInfo holds the information received in PROXY protocol header
+type ProxyInfo struct {
+	Version    int       // PROXY protocol version, 1 or 2
+	SourceAddr net.Addr  // address of the original client
+	DestAddr   net.Addr  // address the original client connected to
+	TLS        *ProxyTLS // TLS connection terminated by the proxy, v2 only, nil if not used
+}
+
+// ProxyTLS holds information about the TLS connection between the client and the proxy
+// as sent in the PP2_TYPE_SSL TLV of PROXY protocol v2 header
+type ProxyTLS struct {
+	Version          string // TLS version, e.g. TLSv1.3
+	CommonName       string // common name of the client certificate
+	Cipher           string // cipher used, e.g. ECDHE-RSA-AES128-GCM-SHA256
+	SigAlg           string // algorithm used to sign the client certificate
+	KeyAlg           string // algorithm of the client certificate key
+	ClientCert       bool   // client presented certificate
+	ClientCertVerify bool   // client certificate was successfully verified
+}
+
+// readProxyHeader reads PROXY protocol header of version 1 or 2 from r
+// the reader is never read past the end of the header so it can be used for TLS handshake afterwards
+// returns nil info if the proxy didn't provide client address (UNKNOWN, LOCAL)
+func readProxyHeader(r io.Reader) (*ProxyInfo, error) {
+	// shortest v1 header is 'PROXY UNKNOWN\r\n', so this never reads past the header
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1(r, start)
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyV1 reads rest of the v1 header line byte by byte and parses it
+func readProxyV1(r io.Reader, start []byte) (*ProxyInfo, error) {
+	line := start
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	src, dst := net.ParseIP(parts[2]), net.ParseIP(parts[3])
+	if src == nil || dst == nil || (parts[1] == "TCP4") != (src.To4() != nil) {
+		return nil, errProxyHeader
+	}
+	srcPort, err := strconv.ParseUint(parts[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	dstPort, err := strconv.ParseUint(parts[5], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &ProxyInfo{
+		Version:    1,
+		SourceAddr: &net.TCPAddr{IP: src, Port: int(srcPort)},
+		DestAddr:   &net.TCPAddr{IP: dst, Port: int(dstPort)},
+	}, nil
+}
+
+// readProxyV2 reads the binary v2 header following the signature
+func readProxyV2(r io.Reader) (*ProxyInfo, error) {
+	hdr := make([]byte, proxyV2HeaderLen-len(proxyV2Signature))
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[0]>>4)
+	}
+	cmd, fam := hdr[0]&0xf, hdr[1]
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// health checks of the proxy itself
+	if cmd == proxyV2CmdLocal {
+		return nil, nil
+	}
+	if cmd != proxyV2CmdProxy {
+		return nil, errProxyHeader
+	}
+
+	info := &ProxyInfo{Version: 2}
+	var addrLen int
+	switch fam {
+	case proxyV2FamTCP4, proxyV2FamUDP4:
+		addrLen = 2*net.IPv4len + 4
+	case proxyV2FamTCP6, proxyV2FamUDP6:
+		addrLen = 2*net.IPv6len + 4
+	default:
+		// unix sockets and unspecified families carry no usable client address
+		return nil, nil
+	}
+	if len(data) < addrLen {
+		return nil, errProxyHeader
+	}
+	ipLen := (addrLen - 4) / 2
+	src := net.IP(append([]byte(nil), data[:ipLen]...))
+	dst := net.IP(append([]byte(nil), data[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(data[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(data[2*ipLen+2:]))
+	if fam == proxyV2FamUDP4 || fam == proxyV2FamUDP6 {
+		info.SourceAddr = &net.UDPAddr{IP: src, Port: srcPort}
+		info.DestAddr = &net.UDPAddr{IP: dst, Port: dstPort}
+	} else {
+		info.SourceAddr = &net.TCPAddr{IP: src, Port: srcPort}
+		info.DestAddr = &net.TCPAddr{IP: dst, Port: dstPort}
+	}
+
+	tlvs, err := parseProxyTLVs(data[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	if ssl, ok := tlvs[proxyV2TypeSSL]; ok {
+		info.TLS, err = parseProxyTLS(ssl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// parseProxyTLVs parses type-length-value vectors of v2 header
+func parseProxyTLVs(data []byte) (map[byte][]byte, error) {
+	tlvs := make(map[byte][]byte)
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, errProxyHeader
+		}
+		l := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+l {
+			return nil, errProxyHeader
+		}
+		tlvs[data[0]] = data[3 : 3+l]
+		data = data[3+l:]
+	}
+	return tlvs, nil
+}
+
+// parseProxyTLS parses value of the PP2_TYPE_SSL TLV
+func parseProxyTLS(data []byte) (*ProxyTLS, error) {
+	// client flags (1 byte) and verify result (4 bytes) followed by sub-TLVs
+	if len(data) < 5 {
+		return nil, errProxyHeader
+	}
+	client := data[0]
+	if client&proxyV2ClientSSL == 0 {
+		return nil, nil
+	}
+	info := &ProxyTLS{
+		ClientCert:       client&(proxyV2ClientCertConn|proxyV2ClientCertSess) != 0,
+		ClientCertVerify: client&(proxyV2ClientCertConn|proxyV2ClientCertSess) != 0 && binary.BigEndian.Uint32(data[1:5]) == 0,
+	}
+	sub, err := parseProxyTLVs(data[5:])
+	if err != nil {
+		return nil, err
+	}
+	info.Version = string(sub[proxyV2SubtypeVer])
+	info.CommonName = string(sub[proxyV2SubtypeCN])
+	info.Cipher = string(sub[proxyV2SubtypeCipher])
+	info.SigAlg = string(sub[proxyV2SubtypeSigAlg])
+	info.KeyAlg = string(sub[proxyV2SubtypeKeyAlg])
+	return info, nil
+}
@@ -0,0 +1,146 @@
+package gosmtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyV2Header builds PROXY protocol v2 header for TCP4 connection with given TLVs
+func proxyV2Header(src, dst string, srcPort, dstPort uint16, tlvs []byte) []byte {
+	addr := append([]byte(nil), net.ParseIP(src).To4()...)
+	addr = append(addr, net.ParseIP(dst).To4()...)
+	addr = append(addr, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	addr = append(addr, tlvs...)
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x21, proxyV2FamTCP4, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addr)))
+	return append(hdr, addr...)
+}
+
+// proxyTLV encodes single type-length-value vector
+func proxyTLV(typ byte, value []byte) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func TestReadProxyHeader_V1(t *testing.T) {
+	r := bytes.NewBufferString("PROXY TCP4 192.168.0.1 192.168.0.11 56324 25\r\nEHLO")
+	info, err := readProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, info.Version)
+	assert.Equal(t, "192.168.0.1:56324", info.SourceAddr.String())
+	assert.Equal(t, "192.168.0.11:25", info.DestAddr.String())
+	assert.Equal(t, "EHLO", r.String(), "nothing past the header should be read")
+
+	info, err = readProxyHeader(bytes.NewBufferString("PROXY TCP6 2001:db8::1 2001:db8::2 4000 25\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4000", info.SourceAddr.String())
+
+	info, err = readProxyHeader(bytes.NewBufferString("PROXY UNKNOWN\r\n"))
+	assert.NoError(t, err)
+	assert.Nil(t, info, "UNKNOWN header carries no address")
+
+	for _, bad := range []string{
+		"EHLO example.com\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 25\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 99999 25\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 25 " + string(make([]byte, 100)) + "\r\n",
+	} {
+		_, err = readProxyHeader(bytes.NewBufferString(bad))
+		assert.Error(t, err, "header %q should be rejected", bad)
+	}
+}
+
+func TestReadProxyHeader_V2(t *testing.T) {
+	ssl := []byte{proxyV2ClientSSL | proxyV2ClientCertConn, 0, 0, 0, 0}
+	ssl = append(ssl, proxyTLV(proxyV2SubtypeVer, []byte("TLSv1.3"))...)
+	ssl = append(ssl, proxyTLV(proxyV2SubtypeCN, []byte("client.example.com"))...)
+	ssl = append(ssl, proxyTLV(proxyV2SubtypeCipher, []byte("TLS_AES_128_GCM_SHA256"))...)
+	tlvs := append(proxyTLV(0x04, []byte{0, 0}), proxyTLV(proxyV2TypeSSL, ssl)...)
+
+	r := bytes.NewBuffer(proxyV2Header("10.0.0.1", "10.0.0.2", 1234, 25, tlvs))
+	r.WriteString("EHLO")
+	info, err := readProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, info.Version)
+	assert.Equal(t, "10.0.0.1:1234", info.SourceAddr.String())
+	assert.Equal(t, "10.0.0.2:25", info.DestAddr.String())
+	assert.Equal(t, "EHLO", r.String(), "nothing past the header should be read")
+	if assert.NotNil(t, info.TLS) {
+		assert.Equal(t, "TLSv1.3", info.TLS.Version)
+		assert.Equal(t, "client.example.com", info.TLS.CommonName)
+		assert.Equal(t, "TLS_AES_128_GCM_SHA256", info.TLS.Cipher)
+		assert.True(t, info.TLS.ClientCert)
+		assert.True(t, info.TLS.ClientCertVerify)
+	}
+
+	// LOCAL command is used by health checks and has no address
+	local := proxyV2Header("10.0.0.1", "10.0.0.2", 1234, 25, nil)
+	local[12] = 0x20
+	info, err = readProxyHeader(bytes.NewBuffer(local))
+	assert.NoError(t, err)
+	assert.Nil(t, info)
+
+	// truncated TLV
+	_, err = readProxyHeader(bytes.NewBuffer(proxyV2Header("10.0.0.1", "10.0.0.2", 1234, 25, []byte{proxyV2TypeSSL, 0, 10})))
+	assert.Error(t, err)
+}
+
+func TestSession_ProxyProtocol(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.TLSConfig = testTLSConfig(t)
+	defer srv.Close()
+	peers := make(chan Peer, 1)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	helo := func(peer *Peer, name string) error {
+		peers <- *peer
+		return nil
+	}
+
+	// trusted proxy
+	addr := startTestListener(t, srv, Listener{ProxyProtocol: true, TrustedProxies: []*net.IPNet{loopback}, HeloChecker: helo})
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 40000 25\r\n"))
+	c := textproto.NewConn(conn)
+	c.ReadResponse(220)
+	testCmd(c, 250, "HELO localhost")
+	peer := <-peers
+	assert.Equal(t, "203.0.113.7:40000", peer.Addr.String(), "peer address should be taken from the PROXY header")
+	assert.NotNil(t, peer.Proxy)
+	c.Close()
+
+	// untrusted source is served as is
+	addr = startTestListener(t, srv, Listener{ProxyProtocol: true, TrustedProxies: []*net.IPNet{other}, HeloChecker: helo})
+	c, err = textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	c.ReadResponse(220)
+	testCmd(c, 250, "HELO localhost")
+	peer = <-peers
+	assert.Equal(t, "127.0.0.1", peer.Addr.(*net.TCPAddr).IP.String())
+	assert.Nil(t, peer.Proxy)
+	c.Close()
+
+	// PROXY header precedes implicit TLS handshake
+	addr = startTestListener(t, srv, Listener{TLSMode: TLSImplicit, ProxyProtocol: true, TrustedProxies: []*net.IPNet{loopback}, HeloChecker: helo})
+	conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	conn.Write(proxyV2Header("203.0.113.8", "192.0.2.1", 40001, 465, nil))
+	client, err := smtp.NewClient(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), "localhost")
+	assert.NoError(t, err, "TLS should be negotiated after the PROXY header")
+	assert.NoError(t, client.Hello("localhost"))
+	peer = <-peers
+	assert.Equal(t, "203.0.113.8:40001", peer.Addr.String())
+	assert.NotNil(t, peer.TLS)
+	client.Close()
+}
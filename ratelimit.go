@@ -0,0 +1,206 @@
+package gosmtp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits how often a client can connect, send messages and add recipients, 0 means unlimited
+type RateLimit struct {
+	ConnectionsPerMinute int // sessions started
+	MessagesPerHour      int // MAIL commands accepted
+	RecipientsPerHour    int // RCPT commands accepted
+}
+
+/*
+RateLimitStore keeps token buckets used for rate limiting.
+The default store keeps the buckets in memory, implement the interface on top of shared
+storage (e.g. Redis) to enforce the limits across several server instances.
+*/
+type RateLimitStore interface {
+	// Allow takes n tokens from each of the buckets atomically, the tokens are taken only if all the buckets
+	// have enough of them, returns false otherwise
+	Allow(n int, buckets ...RateLimitBucket) (bool, error)
+}
+
+// RateLimitBucket identifies token bucket of RateLimitStore
+type RateLimitBucket struct {
+	Key      string
+	Limit    int           // the bucket holds at most Limit tokens
+	Interval time.Duration // and is refilled by Limit tokens per Interval
+}
+
+// rateKind is the kind of action limited by RateLimit
+type rateKind int
+
+const (
+	rateConnections rateKind = iota
+	rateMessages
+	rateRecipients
+)
+
+// String returns name of the kind used in the bucket keys
+func (k rateKind) String() string {
+	switch k {
+	case rateConnections:
+		return "conn"
+	case rateMessages:
+		return "msg"
+	default:
+		return "rcpt"
+	}
+}
+
+// bucket returns size and refill interval of the bucket for given kind
+func (rl RateLimit) bucket(kind rateKind) (int, time.Duration) {
+	switch kind {
+	case rateConnections:
+		return rl.ConnectionsPerMinute, time.Minute
+	case rateMessages:
+		return rl.MessagesPerHour, time.Hour
+	default:
+		return rl.RecipientsPerHour, time.Hour
+	}
+}
+
+// tokenBucket is single bucket of the in-memory store
+type tokenBucket struct {
+	tokens   float64
+	updated  time.Time
+	interval time.Duration
+}
+
+// memoryRateLimitStore is the default RateLimitStore keeping the buckets in memory
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+	now     func() time.Time
+}
+
+// memoryStoreSweepEvery sets how often the in-memory store drops buckets which are full again
+const memoryStoreSweepEvery = 1000
+
+// NewMemoryRateLimitStore returns RateLimitStore which keeps the buckets in memory of the process
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow implements RateLimitStore
+func (m *memoryRateLimitStore) Allow(n int, buckets ...RateLimitBucket) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	refilled := make([]*tokenBucket, len(buckets))
+	for i, bucket := range buckets {
+		refilled[i] = m.refill(bucket.Key, bucket.Limit, bucket.Interval)
+		if refilled[i].tokens < float64(n) {
+			return false, nil
+		}
+	}
+	for _, b := range refilled {
+		b.tokens -= float64(n)
+	}
+	return true, nil
+}
+
+// refill returns the bucket of the key with the tokens added since its last update
+func (m *memoryRateLimitStore) refill(key string, limit int, interval time.Duration) *tokenBucket {
+	now := m.now()
+	m.calls++
+	if m.calls%memoryStoreSweepEvery == 0 {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit), updated: now}
+		m.buckets[key] = b
+	}
+	b.interval = interval
+	b.tokens += now.Sub(b.updated).Seconds() / interval.Seconds() * float64(limit)
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.updated = now
+	return b
+}
+
+// sweep removes buckets which would be full by now, they are the same as missing ones
+func (m *memoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) >= b.interval {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// rateLimits returns rate limits which apply to the session peer and the sender domain, keyed by the bucket prefix
+func (s *session) rateLimits(senderDomain string) map[string]RateLimit {
+	limits := make(map[string]RateLimit, 3)
+	if host, _ := splitHostPort(s.peer.Addr); net.ParseIP(host) != nil {
+		limits["ip:"+host] = s.listener.Limits.RatePerIP
+	}
+	if s.peer.Authenticated && s.peer.Username != "" {
+		limits["user:"+s.peer.Username] = s.listener.Limits.RatePerUser
+	}
+	if senderDomain != "" {
+		limits["domain:"+strings.ToLower(senderDomain)] = s.listener.Limits.RatePerSenderDomain
+	}
+	return limits
+}
+
+// rateAllow takes a token of given kind from the bucket of each of the rate limits, the tokens are taken
+// only if none of the buckets is exhausted, returns false otherwise, errors of the store are logged and ignored
+func (s *session) rateAllow(kind rateKind, limits map[string]RateLimit) bool {
+	if s.srv.RateLimitStore == nil {
+		return true
+	}
+	var buckets []RateLimitBucket
+	var prefixes []string
+	for prefix, rl := range limits {
+		limit, interval := rl.bucket(kind)
+		if limit <= 0 {
+			continue
+		}
+		buckets = append(buckets, RateLimitBucket{Key: prefix + ":" + kind.String(), Limit: limit, Interval: interval})
+		prefixes = append(prefixes, prefix)
+	}
+	if len(buckets) == 0 {
+		return true
+	}
+	ok, err := s.srv.RateLimitStore.Allow(1, buckets...)
+	if err != nil {
+		s.log.Printf("ERROR: rate limit store: %s", err.Error())
+		return true
+	}
+	if !ok {
+		s.log.Printf("INFO: rate limit of %s exceeded by one of %s", kind, strings.Join(prefixes, ", "))
+	}
+	return ok
+}
+
+// rateAllowSession charges the session start to rate limits which were not charged in this session yet
+func (s *session) rateAllowSession(limits map[string]RateLimit) bool {
+	if s.rateCharged == nil {
+		s.rateCharged = make(map[string]bool)
+	}
+	uncharged := make(map[string]RateLimit, len(limits))
+	for prefix, rl := range limits {
+		if !s.rateCharged[prefix] {
+			uncharged[prefix] = rl
+		}
+	}
+	if !s.rateAllow(rateConnections, uncharged) {
+		return false
+	}
+	// rejected session start is checked again by the next command
+	for prefix := range uncharged {
+		s.rateCharged[prefix] = true
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package gosmtp
+
+import (
+	"log"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+	store.now = func() time.Time { return now }
+	key := RateLimitBucket{Key: "key", Limit: 3, Interval: time.Minute}
+	other := RateLimitBucket{Key: "other", Limit: 3, Interval: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		ok, err := store.Allow(1, key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, _ := store.Allow(1, key)
+	assert.False(t, ok, "bucket should be empty")
+	ok, _ = store.Allow(1, other)
+	assert.True(t, ok, "buckets should be independent")
+
+	// one token is refilled every 20 seconds
+	now = now.Add(20 * time.Second)
+	ok, _ = store.Allow(1, key)
+	assert.True(t, ok)
+	ok, _ = store.Allow(1, key)
+	assert.False(t, ok)
+
+	// bucket never holds more than limit tokens
+	now = now.Add(time.Hour)
+	ok, _ = store.Allow(4, key)
+	assert.False(t, ok)
+
+	// tokens are taken from all the buckets or none of them
+	ok, _ = store.Allow(3, other)
+	assert.True(t, ok)
+	ok, _ = store.Allow(1, key, other)
+	assert.False(t, ok)
+	ok, _ = store.Allow(3, key)
+	assert.True(t, ok, "rejected request shouldn't take tokens")
+
+	store.sweep(now.Add(time.Minute))
+	assert.Empty(t, store.buckets, "full buckets should be removed")
+}
+
+func TestSession_rateAllow(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	s := &session{srv: srv, log: srv.log}
+	limits := map[string]RateLimit{
+		"ip:192.0.2.1":       {MessagesPerHour: 2},
+		"domain:example.com": {MessagesPerHour: 1},
+	}
+	assert.True(t, s.rateAllow(rateMessages, limits))
+	assert.False(t, s.rateAllow(rateMessages, limits), "domain bucket should be exhausted")
+	assert.False(t, s.rateAllow(rateMessages, limits), "domain bucket should be exhausted")
+
+	// rejected messages didn't take tokens of the IP
+	delete(limits, "domain:example.com")
+	assert.True(t, s.rateAllow(rateMessages, limits))
+	assert.False(t, s.rateAllow(rateMessages, limits))
+
+	// rejected session start is charged again, not skipped by the next command
+	limits = map[string]RateLimit{"domain:example.org": {ConnectionsPerMinute: 1}}
+	assert.True(t, (&session{srv: srv, log: srv.log}).rateAllowSession(limits))
+	assert.False(t, s.rateAllowSession(limits))
+	assert.False(t, s.rateAllowSession(limits))
+}
+
+func TestSession_RateLimits(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Handler = dummyHandle
+	srv.Limits.RatePerIP = RateLimit{ConnectionsPerMinute: 1}
+	srv.Limits.RatePerSenderDomain = RateLimit{MessagesPerHour: 2, RecipientsPerHour: 1}
+	defer srv.Close()
+	addr := startTestListener(t, srv, Listener{})
+
+	c, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@localhost>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RCPT TO:<first@localhost>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 451, "RCPT TO:<second@localhost>")
+	assert.NoError(t, err, "recipients rate limit of the sender domain should be exceeded")
+	_, _, err = testCmd(c, 250, "RSET")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "MAIL FROM:<other@localhost>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RSET")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 451, "MAIL FROM:<sender@localhost>")
+	assert.NoError(t, err, "messages rate limit of the sender domain should be exceeded")
+
+	second, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer second.Close()
+	_, _, err = second.ReadResponse(220)
+	assert.Error(t, err, "connections rate limit of the IP should be exceeded")
+	assert.Contains(t, err.Error(), "421")
+}
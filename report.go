@@ -0,0 +1,244 @@
+package gosmtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+/*
+RFC 3464, An Extensible Message Format for Delivery Status Notifications
+
+	The DSN is a MIME message with a top-level content-type of
+	multipart/report (defined in [REPORT]).  When a multipart/report
+	content is used to transmit a DSN:
+
+	(a) The report-type parameter of the multipart/report content is
+	    "delivery-status".
+	(b) The first component of the multipart/report contains a human-
+	    readable explanation of the DSN, as described in [REPORT].
+	(c) The second component of the multipart/report is of content-type
+	    message/delivery-status, described in section 2.1 of this
+	    document.
+	(d) If the original message or a portion of the message is to be
+	    returned to the sender, it appears as the third component of the
+	    multipart/report.
+
+RFC 3461 section 6.2, the DSN is sent to the envelope sender with the null reverse-path <>,
+so the DSN itself is never bounced.
+*/
+
+var (
+	// ErrNullSender is returned by NewDSN for messages with the null reverse-path, which must not be bounced
+	ErrNullSender = errors.New("message with null sender can't be bounced")
+	// ErrDSNNotRequested is returned by NewDSN if NOTIFY parameters of all the recipients exclude the report
+	ErrDSNNotRequested = errors.New("delivery status notification not requested")
+	// ErrNoReportingMTA is returned by NewDSN if DSNReport.ReportingMTA is empty
+	ErrNoReportingMTA = errors.New("reporting MTA host name is required")
+)
+
+// DSNAction is the action performed by the reporting MTA for the recipient
+type DSNAction string
+
+const (
+	// DSNActionFailed - the message could not be delivered to the recipient
+	DSNActionFailed DSNAction = "failed"
+	// DSNActionDelayed - the delivery is delayed, the reporting MTA will try again
+	DSNActionDelayed DSNAction = "delayed"
+	// DSNActionDelivered - the message was delivered to the recipient
+	DSNActionDelivered DSNAction = "delivered"
+	// DSNActionRelayed - the message was relayed to environment which doesn't support DSN
+	DSNActionRelayed DSNAction = "relayed"
+	// DSNActionExpanded - the message was delivered and forwarded to multiple addresses
+	DSNActionExpanded DSNAction = "expanded"
+)
+
+// RecipientResult is the delivery result of one envelope recipient
+type RecipientResult struct {
+	Recipient      *mail.Address      // recipient from Envelope.MailTo
+	Action         DSNAction          // performed action
+	Status         EnhancedStatusCode // e.g. {ClassPermanentFailure, MailboxFull}, class follows Action if not set
+	DiagnosticCode string             // reply of the remote server, e.g. '550 5.1.1 No such user', optional
+	RemoteMTA      string             // host name of the remote server, optional
+	WillRetryUntil time.Time          // when the delayed delivery is given up, optional
+}
+
+// DSNReport describes the delivery status notification made by NewDSN
+type DSNReport struct {
+	ReportingMTA string            // host name of the MTA which makes the report, used in From header too, required
+	ArrivalDate  time.Time         // when the message was received, optional
+	Results      []RecipientResult // results of the recipients to report
+}
+
+// NewDSN returns multipart/report DSN message about env addressed to env.MailFrom
+// results are reported according to NOTIFY parameters of the recipients, failures and delays are reported
+// if NOTIFY wasn't used. Original message is attached whole or headers only according to RET parameter.
+// The message has to be sent with the null reverse-path.
+func NewDSN(env *Envelope, report DSNReport) ([]byte, error) {
+	if env.MailFrom == nil || env.MailFrom.Address == "" {
+		return nil, ErrNullSender
+	}
+	if report.ReportingMTA == "" {
+		return nil, ErrNoReportingMTA
+	}
+
+	var results []RecipientResult
+	for _, result := range report.Results {
+		if notifyRequested(env.recipientDSN(result.Recipient).Notify, result.Action) {
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return nil, ErrDSNNotRequested
+	}
+
+	subject := "Successful Mail Delivery Report"
+	for _, result := range results {
+		if result.Action == DSNActionFailed {
+			subject = "Undelivered Mail Returned to Sender"
+			break
+		}
+		if result.Action == DSNActionDelayed {
+			subject = "Delayed Mail (still being retried)"
+		}
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", report.ReportingMTA)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", env.MailFrom.Address)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%d.dsn@%s>\r\n", time.Now().UnixNano(), report.ReportingMTA)
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	// human readable explanation
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=us-ascii"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", report.ReportingMTA)
+	for _, result := range results {
+		fmt.Fprintf(part, "<%s>: %s, %s", result.Recipient.Address, result.Action, dsnStatus(result))
+		if result.DiagnosticCode != "" {
+			fmt.Fprintf(part, ", %s", result.DiagnosticCode)
+		}
+		part.Write([]byte("\r\n"))
+	}
+
+	// machine readable report
+	part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", report.ReportingMTA)
+	if env.DSN.EnvelopeID != "" {
+		fmt.Fprintf(part, "Original-Envelope-Id: %s\r\n", env.DSN.EnvelopeID)
+	}
+	if !report.ArrivalDate.IsZero() {
+		fmt.Fprintf(part, "Arrival-Date: %s\r\n", report.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, result := range results {
+		part.Write([]byte("\r\n"))
+		if dsn := env.recipientDSN(result.Recipient); dsn.OriginalRecipient != "" {
+			fmt.Fprintf(part, "Original-Recipient: %s;%s\r\n", dsn.OriginalRecipientType, dsn.OriginalRecipient)
+		}
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", result.Recipient.Address)
+		fmt.Fprintf(part, "Action: %s\r\n", result.Action)
+		fmt.Fprintf(part, "Status: %s\r\n", dsnStatus(result))
+		if result.RemoteMTA != "" {
+			fmt.Fprintf(part, "Remote-MTA: dns; %s\r\n", result.RemoteMTA)
+		}
+		if result.DiagnosticCode != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", result.DiagnosticCode)
+		}
+		if !result.WillRetryUntil.IsZero() {
+			fmt.Fprintf(part, "Will-Retry-Until: %s\r\n", result.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+
+	// the original message, if it was stored in the envelope
+	if env.Size() > 0 {
+		contentType := "message/rfc822"
+		if env.DSN.Return == DSNReturnHeaders {
+			contentType = "text/rfc822-headers"
+		}
+		part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return nil, err
+		}
+		if env.DSN.Return == DSNReturnHeaders {
+			err = copyHeaders(part, env.DataReader())
+		} else {
+			_, err = io.Copy(part, env.DataReader())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// notifyRequested checks if the action should be reported according to the NOTIFY parameter
+func notifyRequested(notify DSNNotify, action DSNAction) bool {
+	switch action {
+	case DSNActionFailed:
+		return notify == 0 || notify.Has(DSNNotifyFailure)
+	case DSNActionDelayed:
+		return notify == 0 || notify.Has(DSNNotifyDelay)
+	default:
+		return notify.Has(DSNNotifySuccess)
+	}
+}
+
+// dsnStatus returns the status of the result, class is derived from the action if not set
+func dsnStatus(result RecipientResult) string {
+	status := result.Status
+	if status.Class == 0 {
+		switch result.Action {
+		case DSNActionFailed:
+			status.Class = ClassPermanentFailure
+		case DSNActionDelayed:
+			status.Class = ClassTransientFailure
+		default:
+			status.Class = ClassSuccess
+		}
+	}
+	if status.SubjectDetailCode == "" {
+		status.SubjectDetailCode = OtherStatus
+	}
+	return status.String()
+}
+
+// copyHeaders copies the header section of the message, up to the first empty line
+func copyHeaders(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "" {
+			return nil
+		}
+		if _, werr := io.WriteString(w, line); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package gosmtp
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDSNEnvelope(ret DSNReturn) *Envelope {
+	env := NewEnvelope()
+	env.MailFrom = &mail.Address{Address: "sender@example.com"}
+	env.DSN = DSN{Return: ret, EnvelopeID: "QQ314661"}
+	env.addRecipient(&mail.Address{Address: "a@example.org"}, RecipientDSN{OriginalRecipientType: "rfc822", OriginalRecipient: "A@example.org"})
+	env.addRecipient(&mail.Address{Address: "b@example.org"}, RecipientDSN{Notify: DSNNotifyNever})
+	env.addRecipient(&mail.Address{Address: "c@example.org"}, RecipientDSN{Notify: DSNNotifyDelay})
+	env.BeginData()
+	env.WriteString("Subject: original\r\n\r\nsecret body\r\n")
+	return env
+}
+
+// testDSNParts returns content types and contents of the DSN parts
+func testDSNParts(t *testing.T, msg []byte) ([]string, []string) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	assert.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/report", mediaType)
+	assert.Equal(t, "delivery-status", params["report-type"])
+	assert.Equal(t, "<sender@example.com>", m.Header.Get("To"))
+
+	var types, contents []string
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		content, _ := io.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		contents = append(contents, string(content))
+	}
+	return types, contents
+}
+
+func TestNewDSN(t *testing.T) {
+	env := testDSNEnvelope(DSNReturnHeaders)
+	msg, err := NewDSN(env, DSNReport{
+		ReportingMTA: "mx.example.com",
+		Results: []RecipientResult{
+			{Recipient: env.MailTo[0], Action: DSNActionFailed, Status: EnhancedStatusCode{ClassPermanentFailure, BadDestinationMailboxAddress}, DiagnosticCode: "550 5.1.1 No such user"},
+			{Recipient: env.MailTo[1], Action: DSNActionFailed, Status: EnhancedStatusCode{ClassPermanentFailure, MailboxFull}},
+			{Recipient: env.MailTo[2], Action: DSNActionDelayed, Status: EnhancedStatusCode{ClassTransientFailure, DeliveryTimeExpired}},
+		},
+	})
+	assert.NoError(t, err)
+
+	types, contents := testDSNParts(t, msg)
+	assert.Equal(t, []string{"text/plain; charset=us-ascii", "message/delivery-status", "text/rfc822-headers"}, types)
+	assert.Contains(t, contents[1], "Reporting-MTA: dns; mx.example.com\r\nOriginal-Envelope-Id: QQ314661\r\n")
+	assert.Contains(t, contents[1], "\r\n\r\nOriginal-Recipient: rfc822;A@example.org\r\nFinal-Recipient: rfc822; a@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n")
+	assert.NotContains(t, contents[1], "b@example.org", "recipient with NOTIFY=NEVER shouldn't be reported")
+	assert.Contains(t, contents[1], "Final-Recipient: rfc822; c@example.org\r\nAction: delayed\r\nStatus: 4.4.7\r\n")
+	assert.Equal(t, "Subject: original\r\n", contents[2], "only headers should be returned for RET=HDRS")
+
+	env = testDSNEnvelope("")
+	msg, err = NewDSN(env, DSNReport{
+		ReportingMTA: "mx.example.com",
+		Results:      []RecipientResult{{Recipient: env.MailTo[0], Action: DSNActionFailed}},
+	})
+	assert.NoError(t, err)
+	types, contents = testDSNParts(t, msg)
+	assert.Equal(t, "message/rfc822", types[2])
+	assert.Equal(t, "Subject: original\r\n\r\nsecret body\r\n", contents[2])
+	assert.Contains(t, contents[1], "Status: 5.0.0\r\n")
+}
+
+func TestNewDSN_NotSent(t *testing.T) {
+	env := testDSNEnvelope("")
+	_, err := NewDSN(env, DSNReport{ReportingMTA: "mx.example.com", Results: []RecipientResult{
+		{Recipient: env.MailTo[0], Action: DSNActionDelivered},
+		{Recipient: env.MailTo[1], Action: DSNActionFailed},
+	}})
+	assert.Equal(t, ErrDSNNotRequested, err)
+
+	_, err = NewDSN(env, DSNReport{Results: []RecipientResult{{Recipient: env.MailTo[1], Action: DSNActionFailed}}})
+	assert.Equal(t, ErrNoReportingMTA, err, "host name is needed in the report and headers")
+
+	env.MailFrom = &mail.Address{}
+	_, err = NewDSN(env, DSNReport{Results: []RecipientResult{{Recipient: env.MailTo[0], Action: DSNActionFailed}}})
+	assert.Equal(t, ErrNullSender, err, "null sender must not be bounced")
+}
@@ -185,6 +185,15 @@ type Responses struct {
 	FailEncryptionNeeded                   string
 	FailMissingArgument                    string
 	FailUndefinedSecurityStatus            string
+	FailXclientNotAuthorized               string
+	FailTransactionInProgress              string
+	FailParameterNotRecognized             string
+	FailBareLineEnding                     string
+	FailInvalidBdatCmd                     string
+	FailNonASCIIAddress                    string
+	FailEightBitData                       string
+	FailAuthCancelled                      string
+	FailAuthMalformed                      string
 
 	// The 400's
 	ErrorTooManyRecipients      string
@@ -194,6 +203,9 @@ type Responses struct {
 	ErrorAuth                   string
 	ErrorUnableToResolveHost    string
 	ErrorCmdParamNotImplemented string
+	ErrorRateLimit              string
+	ErrorRateLimitConnection    string
+	ErrorAuthLockout            string
 
 	// The 200's
 	SuccessAuthentication string
@@ -207,6 +219,8 @@ type Responses struct {
 	SuccessHelpCmd        string
 	SuccessStartTLSCmd    string
 	SuccessMessageQueued  string
+	SuccessXforwardCmd    string
+	SuccessBdatCmd        string
 }
 
 // Called automatically during package load to build up the Responses struct
@@ -283,7 +297,7 @@ func init() {
 	Codes.FailTooBig = (&Response{
 		EnhancedCode: MessageLengthExceedsAdministrativeLimit,
 		BasicCode:    552,
-		Class:        ClassTransientFailure,
+		Class:        ClassPermanentFailure,
 		Comment:      "Message exceeds maximum size!",
 	}).String()
 
@@ -301,6 +315,27 @@ func init() {
 		Comment:      "Relay access denied!",
 	}).String()
 
+	Codes.ErrorRateLimit = (&Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Rate limit exceeded, try again later!",
+	}).String()
+
+	Codes.ErrorRateLimitConnection = (&Response{
+		EnhancedCode: SecurityStatus,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many connections, try again later!",
+	}).String()
+
+	Codes.ErrorAuthLockout = (&Response{
+		EnhancedCode: SecurityStatus,
+		BasicCode:    454,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many failed authentications, try again later!",
+	}).String()
+
 	Codes.ErrorAuth = (&Response{
 		EnhancedCode: OtherOrUndefinedMailSystemStatus,
 		BasicCode:    454,
@@ -491,6 +526,20 @@ func init() {
 		Comment:      "ERR transaction timeout",
 	}).String()
 
+	Codes.FailAuthCancelled = (&Response{
+		EnhancedCode: OtherStatus,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Authentication cancelled",
+	}).String()
+
+	Codes.FailAuthMalformed = (&Response{
+		EnhancedCode: SyntaxError,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Cannot decode authentication response",
+	}).String()
+
 	Codes.FailAuthentication = (&Response{
 		EnhancedCode: OtherOrUndefinedProtocolStatus,
 		BasicCode:    535,
@@ -520,10 +569,31 @@ func init() {
 	}).String()
 
 	Codes.FailBadDestinationMailboxAddressSyntax = (&Response{
-		EnhancedCode: BadSendersMailboxAddressSyntax,
+		EnhancedCode: BadDestinationMailboxAddressSyntax,
 		BasicCode:    501,
 		Class:        ClassPermanentFailure,
-		Comment:      "Bad sender address syntax",
+		Comment:      "Bad recipient address syntax",
+	}).String()
+
+	Codes.FailBareLineEnding = (&Response{
+		EnhancedCode: SyntaxError,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Bare CR or LF in message data, use CRLF line endings",
+	}).String()
+
+	Codes.FailEightBitData = (&Response{
+		EnhancedCode: OtherOrUndefinedMediaError,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "8-bit data in message declared as 7-bit, use BODY=8BITMIME",
+	}).String()
+
+	Codes.FailParameterNotRecognized = (&Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    555,
+		Class:        ClassPermanentFailure,
+		Comment:      "Parameter not recognized or not implemented",
 	}).String()
 
 	Codes.FailEncryptionNeeded = (&Response{
@@ -539,6 +609,48 @@ func init() {
 		Class:        ClassPermanentFailure,
 		Comment:      "Undefined security failure",
 	}).String()
+
+	Codes.FailXclientNotAuthorized = (&Response{
+		EnhancedCode: SecurityStatus,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Insufficient authorization",
+	}).String()
+
+	Codes.FailTransactionInProgress = (&Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    503,
+		Class:        ClassPermanentFailure,
+		Comment:      "Mail transaction in progress",
+	}).String()
+
+	Codes.SuccessXforwardCmd = (&Response{
+		EnhancedCode: OtherStatus,
+		BasicCode:    250,
+		Class:        ClassSuccess,
+		Comment:      "OK",
+	}).String()
+
+	Codes.SuccessBdatCmd = (&Response{
+		EnhancedCode: OtherStatus,
+		BasicCode:    250,
+		Class:        ClassSuccess,
+		Comment:      "OK, octets received:",
+	}).String()
+
+	Codes.FailNonASCIIAddress = (&Response{
+		EnhancedCode: NonASCIIAddressesNotPermitted,
+		BasicCode:    553,
+		Class:        ClassPermanentFailure,
+		Comment:      "Non-ASCII addresses not permitted without SMTPUTF8",
+	}).String()
+
+	Codes.FailInvalidBdatCmd = (&Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Syntax: BDAT chunk-size [LAST]",
+	}).String()
 }
 
 // DefaultMap contains defined default codes (RfC 3463)
@@ -583,6 +695,7 @@ const (
 	ConversionRequiredButNotSupported         = ".6.3"
 	ConversionWithLossPerformed               = ".6.4"
 	ConversionFailed                          = ".6.5"
+	NonASCIIAddressesNotPermitted             = ".6.7"
 	SecurityStatus                            = ".7.0"
 	DeliveryNotAuthorized                     = ".7.1"
 	MailingListExpansionProhibited            = ".7.2"
@@ -659,3 +772,36 @@ func getBasicStatusCode(e EnhancedStatusCode) int {
 	// Fallback if code is not defined
 	return int(e.Class) * 100
 }
+
+/*
+Error is an error carrying the exact SMTP reply.
+Return it from Handler, Authenticator or any of the checkers to control the reply sent to the client,
+other errors are reported with generic reply of the command.
+*/
+type Error struct {
+	Code         int                // basic status code, e.g. 550, derived from EnhancedCode if 0
+	EnhancedCode EnhancedStatusCode // enhanced status code, e.g. 5.1.1, X.0.0 if not set
+	Message      string             // human readable text of the reply
+}
+
+// NewError returns Error with given codes and message, e.g. NewError(550, ClassPermanentFailure, BadDestinationMailboxAddress, "No such user")
+func NewError(code int, class class, detail subjectDetail, message string) *Error {
+	return &Error{Code: code, EnhancedCode: EnhancedStatusCode{class, detail}, Message: message}
+}
+
+// Error returns the SMTP reply line, e.g. '550 5.1.1 No such user'
+func (e *Error) Error() string {
+	enhanced := e.EnhancedCode
+	if enhanced.Class == 0 {
+		enhanced.Class = class(e.Code / 100)
+	}
+	if enhanced.SubjectDetailCode == "" {
+		enhanced.SubjectDetailCode = OtherStatus
+	}
+	return (&Response{
+		EnhancedCode: enhanced.SubjectDetailCode,
+		BasicCode:    e.Code,
+		Class:        enhanced.Class,
+		Comment:      e.Message,
+	}).String()
+}
@@ -0,0 +1,20 @@
+package gosmtp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError_Error(t *testing.T) {
+	assert.Equal(t, "550 5.1.1 No such user", NewError(550, ClassPermanentFailure, BadDestinationMailboxAddress, "No such user").Error())
+	assert.Equal(t, "452 4.3.1 Out of space", (&Error{EnhancedCode: EnhancedStatusCode{ClassTransientFailure, MailSystemFull}, Message: "Out of space"}).Error())
+	assert.Equal(t, "421 4.0.0 Go away", (&Error{Code: 421, Message: "Go away"}).Error())
+	assert.Equal(t, "550 5.1.1 Couldn't find recipient with given email address", ErrorRecipientNotFound.Error())
+
+	var smtpErr *Error
+	assert.True(t, errors.As(fmt.Errorf("lookup: %w", ErrorRecipientsMailboxFull), &smtpErr), "wrapped Error should be recognized")
+	assert.Equal(t, 552, smtpErr.Code)
+}
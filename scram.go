@@ -0,0 +1,290 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+/*
+RFC 5802, Salted Challenge Response Authentication Mechanism (SCRAM)
+
+	SaltedPassword  := Hi(Normalize(password), salt, i)
+	ClientKey       := HMAC(SaltedPassword, "Client Key")
+	StoredKey       := H(ClientKey)
+	AuthMessage     := client-first-message-bare + "," +
+	                   server-first-message + "," +
+	                   client-final-message-without-proof
+	ClientSignature := HMAC(StoredKey, AuthMessage)
+	ClientProof     := ClientKey XOR ClientSignature
+	ServerKey       := HMAC(SaltedPassword, "Server Key")
+	ServerSignature := HMAC(ServerKey, AuthMessage)
+
+The server stores only salt, iteration count, StoredKey and ServerKey. The -PLUS variants bind the
+exchange to the TLS connection, tls-exporter (RFC 9266) and tls-unique channel bindings are supported.
+*/
+
+// scramIterations is the iteration count of the fake credentials of unknown users
+const scramIterations = 4096
+
+// scramFakeSaltKey derives the salts of unknown users, so each of them gets the same salt every time like real users
+var scramFakeSaltKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// SCRAMCredentials are the stored credentials of a user, see NewSCRAMCredentials
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SCRAMLookup returns the stored credentials of the user, nil if the user doesn't exist
+type SCRAMLookup func(ctx context.Context, peer *Peer, username string) (*SCRAMCredentials, error)
+
+// NewSCRAMCredentials derives the stored credentials from the password, h is the hash of the mechanism,
+// e.g. sha256.New for SCRAM-SHA-256. The password should be normalized by SASLprep.
+func NewSCRAMCredentials(h func() hash.Hash, password string, salt []byte, iterations int) (*SCRAMCredentials, error) {
+	salted, err := pbkdf2.Key(h, password, salt, iterations, h().Size())
+	if err != nil {
+		return nil, err
+	}
+	clientKey := scramHMAC(h, salted, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHMAC(h, salted, []byte("Server Key")),
+	}, nil
+}
+
+// SCRAMSHA1Mechanisms returns SCRAM-SHA-1-PLUS and SCRAM-SHA-1 mechanisms, credentials are returned by lookup
+func SCRAMSHA1Mechanisms(lookup SCRAMLookup) []SASLMechanism {
+	return scramMechanisms("SCRAM-SHA-1", sha1.New, lookup)
+}
+
+// SCRAMSHA256Mechanisms returns SCRAM-SHA-256-PLUS and SCRAM-SHA-256 mechanisms, credentials are returned by lookup
+func SCRAMSHA256Mechanisms(lookup SCRAMLookup) []SASLMechanism {
+	return scramMechanisms("SCRAM-SHA-256", sha256.New, lookup)
+}
+
+func scramMechanisms(name string, h func() hash.Hash, lookup SCRAMLookup) []SASLMechanism {
+	return []SASLMechanism{
+		&scramMechanism{name: name + "-PLUS", hash: h, lookup: lookup, plus: true},
+		&scramMechanism{name: name, hash: h, lookup: lookup},
+	}
+}
+
+func scramHMAC(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+type scramMechanism struct {
+	name   string
+	hash   func() hash.Hash
+	lookup SCRAMLookup
+	plus   bool // channel binding is required
+}
+
+func (m *scramMechanism) Name() string {
+	return m.name
+}
+
+func (m *scramMechanism) Start(peer *Peer) SASLServer {
+	return &scramServer{mech: m, peer: peer}
+}
+
+type scramServer struct {
+	mech        *scramMechanism
+	peer        *Peer
+	step        int
+	gs2Header   string
+	cbData      []byte
+	nonce       string
+	authMessage string
+	creds       *SCRAMCredentials
+	unknown     bool // the user doesn't exist, fake credentials are used
+}
+
+func (sc *scramServer) Next(ctx context.Context, response []byte) ([]byte, bool, error) {
+	switch {
+	case response == nil && sc.step == 0:
+		// the client sends the first message
+		return []byte{}, false, nil
+	case sc.step == 0:
+		sc.step++
+		return sc.first(ctx, string(response))
+	default:
+		return sc.final(string(response))
+	}
+}
+
+// first processes client-first-message and returns server-first-message
+func (sc *scramServer) first(ctx context.Context, msg string) ([]byte, bool, error) {
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, ErrAuthMalformed
+	}
+	flag, authzid, bare := parts[0], parts[1], parts[2]
+	sc.gs2Header = flag + "," + authzid + ","
+
+	switch {
+	case strings.HasPrefix(flag, "p="):
+		if !sc.mech.plus {
+			return nil, false, ErrAuthMalformed
+		}
+		data, err := channelBinding(sc.peer, flag[2:])
+		if err != nil {
+			return nil, false, ErrAuthFailed
+		}
+		sc.cbData = data
+	case sc.mech.plus:
+		// -PLUS mechanism requires channel binding
+		return nil, false, ErrAuthMalformed
+	case flag == "y":
+		// the client supports channel binding but thinks the server doesn't, -PLUS is offered under TLS
+		if sc.peer.TLS != nil {
+			return nil, false, ErrAuthFailed
+		}
+	case flag != "n":
+		return nil, false, ErrAuthMalformed
+	}
+
+	// client-first-message-bare = [reserved-mext ","] username "," nonce ["," extensions]
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, false, ErrAuthMalformed
+	}
+	username, err := decodeSASLName(attrs[0][2:])
+	if err != nil || username == "" {
+		return nil, false, ErrAuthMalformed
+	}
+	if authzid != "" {
+		if !strings.HasPrefix(authzid, "a=") {
+			return nil, false, ErrAuthMalformed
+		}
+		if sc.peer.AuthorizationID, err = decodeSASLName(authzid[2:]); err != nil {
+			return nil, false, ErrAuthMalformed
+		}
+	}
+	sc.peer.Username = username
+
+	sc.creds, err = sc.mech.lookup(ctx, sc.peer, username)
+	if err != nil {
+		return nil, false, err
+	}
+	if sc.creds == nil {
+		// continue with fake credentials so it's not revealed whether the user exists
+		sc.unknown = true
+		salt := scramHMAC(sha256.New, scramFakeSaltKey, []byte(username))[:16]
+		sc.creds = &SCRAMCredentials{Salt: salt, Iterations: scramIterations}
+	}
+
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	sc.nonce = attrs[1][2:] + base64.StdEncoding.EncodeToString(nonce)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", sc.nonce, base64.StdEncoding.EncodeToString(sc.creds.Salt), sc.creds.Iterations)
+	sc.authMessage = bare + "," + serverFirst
+	return []byte(serverFirst), false, nil
+}
+
+// final processes client-final-message and returns server-final-message
+func (sc *scramServer) final(msg string) ([]byte, bool, error) {
+	// client-final-message = channel-binding "," nonce ["," extensions] "," proof
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, false, ErrAuthMalformed
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return nil, false, ErrAuthMalformed
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, false, ErrAuthMalformed
+	}
+	binding, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil {
+		return nil, false, ErrAuthMalformed
+	}
+	if !hmac.Equal(binding, append([]byte(sc.gs2Header), sc.cbData...)) || attrs[1][2:] != sc.nonce {
+		return nil, false, ErrAuthFailed
+	}
+	if sc.unknown {
+		return nil, false, ErrAuthFailed
+	}
+
+	sc.authMessage += "," + withoutProof
+	clientSignature := scramHMAC(sc.mech.hash, sc.creds.StoredKey, []byte(sc.authMessage))
+	if len(proof) != len(clientSignature) {
+		return nil, false, ErrAuthFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sc.mech.hash()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), sc.creds.StoredKey) {
+		return nil, false, ErrAuthFailed
+	}
+
+	serverSignature := scramHMAC(sc.mech.hash, sc.creds.ServerKey, []byte(sc.authMessage))
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// decodeSASLName decodes saslname, "=2C" and "=3D" stand for "," and "="
+func decodeSASLName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", errors.New("invalid saslname")
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// channelBinding returns channel binding data of the TLS connection of the peer
+func channelBinding(peer *Peer, name string) ([]byte, error) {
+	if peer.TLS == nil {
+		return nil, errors.New("channel binding requires TLS")
+	}
+	switch name {
+	case "tls-exporter":
+		return peer.TLS.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case "tls-unique":
+		if len(peer.TLS.TLSUnique) == 0 {
+			return nil, errors.New("tls-unique is not available")
+		}
+		return peer.TLS.TLSUnique, nil
+	}
+	return nil, errors.New("unsupported channel binding " + strconv.Quote(name))
+}
@@ -0,0 +1,135 @@
+package gosmtp
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"hash"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scramClientProof computes the client proof, the client side of the exchange
+func scramClientProof(h func() hash.Hash, password string, salt []byte, iterations int, authMessage string) []byte {
+	salted, _ := pbkdf2.Key(h, password, salt, iterations, h().Size())
+	clientKey := scramHMAC(h, salted, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	signature := scramHMAC(h, storedKey.Sum(nil), []byte(authMessage))
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	return clientKey
+}
+
+func TestNewSCRAMCredentials(t *testing.T) {
+	// RFC 7677 example
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	creds, err := NewSCRAMCredentials(sha256.New, "pencil", salt, 4096)
+	assert.NoError(t, err)
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096,c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	assert.Equal(t, "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		base64.StdEncoding.EncodeToString(scramHMAC(sha256.New, creds.ServerKey, []byte(authMessage))))
+	assert.Equal(t, "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		base64.StdEncoding.EncodeToString(scramClientProof(sha256.New, "pencil", salt, 4096, authMessage)))
+}
+
+func TestDecodeSASLName(t *testing.T) {
+	name, err := decodeSASLName("a=2Cb=3Dc")
+	assert.NoError(t, err)
+	assert.Equal(t, "a,b=c", name)
+	_, err = decodeSASLName("a=b")
+	assert.Error(t, err)
+}
+
+func TestSCRAMUnknownUser(t *testing.T) {
+	mech := SCRAMSHA256Mechanisms(func(context.Context, *Peer, string) (*SCRAMCredentials, error) {
+		return nil, nil
+	})[1]
+	salt := func(username string) string {
+		serverFirst, _, err := mech.Start(&Peer{}).Next(context.Background(), []byte("n,,n="+username+",r=nonce"))
+		assert.NoError(t, err)
+		return strings.Split(string(serverFirst), ",")[1]
+	}
+	// the salt doesn't reveal the user doesn't exist by changing with each attempt
+	assert.Equal(t, salt("ghost"), salt("ghost"))
+	assert.NotEqual(t, salt("ghost"), salt("phantom"))
+}
+
+func TestServer_AuthSCRAM(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	defer srv.Close()
+	salt := []byte("salt of the user")
+	creds256, _ := NewSCRAMCredentials(sha256.New, "pencil", salt, 4096)
+	creds1, _ := NewSCRAMCredentials(sha1.New, "pencil", salt, 4096)
+	lookup := func(creds *SCRAMCredentials) SCRAMLookup {
+		return func(ctx context.Context, peer *Peer, username string) (*SCRAMCredentials, error) {
+			if username == "user" {
+				return creds, nil
+			}
+			return nil, nil
+		}
+	}
+	mechs := append(SCRAMSHA256Mechanisms(lookup(creds256)), SCRAMSHA1Mechanisms(lookup(creds1))...)
+	assert.NoError(t, srv.Auth(nil, mechs...))
+
+	// exchange runs SCRAM exchange and returns the final reply code
+	exchange := func(mech string, h func() hash.Hash, gs2Header string, binding func(tls.ConnectionState) []byte, username, password string) int {
+		c := testAuthClient(t, srv)
+		defer c.Close()
+		var cbData []byte
+		if binding != nil {
+			state, _ := c.TLSConnectionState()
+			cbData = binding(state)
+		}
+		clientFirst := "n=" + username + ",r=fyko+d2lbbFgONRv9qkxdawL"
+		code, msg, err := testCmd(c.Text, 334, "AUTH "+mech+" "+base64.StdEncoding.EncodeToString([]byte(gs2Header+clientFirst)))
+		if err != nil {
+			return code
+		}
+		serverFirst, _ := base64.StdEncoding.DecodeString(msg)
+		attrs := strings.Split(string(serverFirst), ",")
+		salt, _ := base64.StdEncoding.DecodeString(attrs[1][2:])
+		iterations, _ := strconv.Atoi(attrs[2][2:])
+		withoutProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...)) + "," + attrs[0]
+		authMessage := clientFirst + "," + string(serverFirst) + "," + withoutProof
+		proof := scramClientProof(h, password, salt, iterations, authMessage)
+		code, msg, err = testCmd(c.Text, 334, base64.StdEncoding.EncodeToString([]byte(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof))))
+		if err != nil {
+			return code
+		}
+
+		// server signature is sent with the success
+		serverFinal, _ := base64.StdEncoding.DecodeString(msg)
+		creds, _ := NewSCRAMCredentials(h, password, salt, iterations)
+		assert.Equal(t, "v="+base64.StdEncoding.EncodeToString(scramHMAC(h, creds.ServerKey, []byte(authMessage))), string(serverFinal))
+		code, _, _ = testCmd(c.Text, 235, "")
+		return code
+	}
+	exporter := func(state tls.ConnectionState) []byte {
+		data, _ := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		return data
+	}
+	otherExporter := func(tls.ConnectionState) []byte {
+		return make([]byte, 32)
+	}
+
+	assert.Equal(t, 235, exchange("SCRAM-SHA-256", sha256.New, "n,,", nil, "user", "pencil"))
+	assert.Equal(t, 235, exchange("SCRAM-SHA-1", sha1.New, "n,,", nil, "user", "pencil"))
+	assert.Equal(t, 535, exchange("SCRAM-SHA-256", sha256.New, "n,,", nil, "user", "wrong"))
+	assert.Equal(t, 535, exchange("SCRAM-SHA-256", sha256.New, "n,,", nil, "nobody", "pencil"))
+	assert.Equal(t, 535, exchange("SCRAM-SHA-256", sha256.New, "y,,", nil, "user", "pencil"), "downgrade should be detected")
+	assert.Equal(t, 501, exchange("SCRAM-SHA-256-PLUS", sha256.New, "n,,", nil, "user", "pencil"))
+	assert.Equal(t, 235, exchange("SCRAM-SHA-256-PLUS", sha256.New, "p=tls-exporter,,", exporter, "user", "pencil"))
+	assert.Equal(t, 535, exchange("SCRAM-SHA-256-PLUS", sha256.New, "p=tls-exporter,,", otherExporter, "user", "pencil"),
+		"binding of other connection should be rejected")
+}
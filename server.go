@@ -2,12 +2,15 @@ package gosmtp
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/mail"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,10 +27,16 @@ type MailHandler interface {
 }
 
 // ErrorRecipientNotFound is returned when the email is inbound but the user is not found
-var ErrorRecipientNotFound = errors.New("Couldn't find recipient with given email address")
+var ErrorRecipientNotFound error = NewError(550, ClassPermanentFailure, BadDestinationMailboxAddress, "Couldn't find recipient with given email address")
 
 // ErrorRecipientsMailboxFull is returned when the user's mailbox is full
-var ErrorRecipientsMailboxFull = errors.New("Recipients mailbox is full")
+var ErrorRecipientsMailboxFull error = NewError(552, ClassPermanentFailure, MailboxFull, "Recipients mailbox is full")
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown or Close
+var ErrServerClosed = errors.New("smtp: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether in-flight sessions finished
+const shutdownPollInterval = 100 * time.Millisecond
 
 /*
 Server - full feature, RFC compliant, SMTP server implementation
@@ -38,10 +47,33 @@ type Server struct {
 	Hostname       string      // hostname, e.g. the domain which the server runs on
 	TLSConfig      *tls.Config // TLS configuration
 	TLSOnly        bool
-	log            *log.Logger // servers logger
-	authMechanisms []string    // announced authentication mechanisms
+	LMTP           bool            // speak LMTP (RFC 2033) instead of SMTP, see Listener for LMTP on Unix socket
+	Listeners      []Listener      // listeners with their own roles, Addr, TLSConfig, TLSOnly and LMTP are used if empty
+	log            *log.Logger     // servers logger
+	authMechanisms []SASLMechanism // announced authentication mechanisms
+
+	// TrustedNetworks are allowed to use XCLIENT and XFORWARD to pass on the original client information
+	TrustedNetworks []*net.IPNet
+
+	// BareLineEndings sets how bare CR and LF in message data are handled, the message is rejected by default
+	BareLineEndings BareLineEndingPolicy
+
+	// Extensions enables or disables the service extensions announced in EHLO reply, e.g. {ExtPipelining: false},
+	// extensions not listed keep their default state, all but MT-PRIORITY are enabled by default.
+	// STARTTLS, AUTH, XCLIENT and XFORWARD are announced only if they are configured.
+	Extensions map[Extension]bool
 
-	shuttingDown bool // is the server shutting down?
+	// EightBitData sets how 8-bit data in message declared as 7-bit are handled, the message is accepted by default
+	EightBitData EightBitPolicy
+
+	// RateLimitStore keeps state of the rate limits set in Limits, rate limiting is disabled if nil
+	RateLimitStore RateLimitStore
+
+	shuttingDown bool                      // is the server shutting down?
+	listeners    map[net.Listener]struct{} // listeners currently accepting connections
+	sessions     map[*session]struct{}     // sessions currently being served
+	conns        connCounter               // concurrent sessions counts for limits
+	authGuard    authGuard                 // failed authentication counts for Limits.AuthFailures
 
 	// Limits
 	Limits Limits
@@ -49,39 +81,101 @@ type Server struct {
 	// New e-mails are handed off to this function.
 	// Can be left empty for a NOOP server.
 	// Returned ID should be ID of the queued email if the email is put into outgoing queue
-	// If an error is returned, it will be reported in the SMTP session.
+	// If an error is returned, it will be reported in the SMTP session, use Error for exact reply.
 	Handler func(peer *Peer, env *Envelope) (string, error)
 
+	// StreamHandler is used instead of Handler if set, it gets the message data while they are still arriving.
+	// The data are prefixed by the headers added by the server, env.Mail is not set and the data are not
+	// stored in the envelope. If the message is rejected or the client disconnects, reading r fails with
+	// the reason. The handler has to return once r is read up to io.EOF, it's limited by Limits.MsgInput.
+	StreamHandler func(ctx context.Context, peer *Peer, env *Envelope, r io.Reader) (string, error)
+
+	// RecipientHandler is used instead of Handler if set, it returns result for each of env.MailTo in the same order,
+	// nil if the message was accepted for the recipient. If the message was accepted for some of the recipients,
+	// the client gets success, temporary failures are passed to DeferHandler and the failures are reported
+	// by DSN passed to DSNHandler. Otherwise the client gets the first temporary error if there is any,
+	// so it tries again later, or the first permanent error.
+	// Use Error to set status codes of the results, errors other than 5xx Error are temporary failures.
+	RecipientHandler func(ctx context.Context, peer *Peer, env *Envelope) (string, []error)
+
+	// DeferHandler gets recipients which failed temporarily when the message was accepted for the others,
+	// the message has to be kept and delivered to them later. The failures are permanent if it's nil.
+	DeferHandler func(peer *Peer, env *Envelope, rcpts []*mail.Address)
+
+	// DSNHandler gets the DSN messages about recipients rejected by RecipientHandler, see NewDSN.
+	// The DSN should be sent to env.MailFrom with the null reverse-path, the failures are only logged if it's nil.
+	DSNHandler func(peer *Peer, env *Envelope, dsn []byte)
+
+	// Messages bigger than SpoolThreshold are stored in temporary file in SpoolDir instead of memory.
+	// The messages are never spooled if SpoolThreshold is 0, SpoolDir defaults to os.TempDir.
+	SpoolThreshold int64
+	SpoolDir       string
+
 	// Enable PLAIN/LOGIN authentication
+	// If an Error is returned, its reply is sent to the client instead of the generic one.
 	Authenticator func(peer *Peer, password []byte) (bool, error)
 
+	// Authorizer decides if the authenticated peer.Username may act as authzid, the authorization identity
+	// requested by the client, e.g. by PLAIN. Such requests are rejected if it's nil.
+	Authorizer func(ctx context.Context, peer *Peer, authzid string) (bool, error)
+
+	// AuthLockout is called when client IP or user is locked out after too many failed authentications,
+	// key is "ip:" followed by the IP address or "user:" followed by the user name, see Limits.AuthFailures
+	AuthLockout func(peer *Peer, key string, until time.Time)
+
+	// CertificateAuth authenticates clients with verified TLS certificate as soon as TLS is established,
+	// so e.g. relays using mutual TLS don't need AUTH. Use ExternalMechanism to authenticate by
+	// the certificate only if the client asks for it.
+	CertificateAuth CertificateMapper
+
 	// Enable various checks during the SMTP session.
 	// Can be left empty for no restrictions.
 	// If an error is returned, it will be reported in the SMTP session.
-	// Use the Error struct for access to error codes.
+	// Use the Error struct to send exact reply code, other errors are appended to generic reply.
 	ConnectionChecker func(peer *Peer) error                     // Called upon new connection.
 	HeloChecker       func(peer *Peer, name string) error        // Called after HELO/EHLO.
 	SenderChecker     func(peer *Peer, addr *mail.Address) error // Called after MAIL FROM.
 	RecipientChecker  func(peer *Peer, addr *mail.Address) error // Called after each RCPT TO.
+
+	// Context aware versions of the hooks, used instead of the ones above if set.
+	// The context is canceled when the client disconnects or the session ends and carries
+	// the session ID and Peer, see SessionID and PeerFromContext. Checkers and Authenticator
+	// are limited by Limits.CmdInput, Handler by Limits.MsgInput.
+	HandlerContext           func(ctx context.Context, peer *Peer, env *Envelope) (string, error)
+	AuthenticatorContext     func(ctx context.Context, peer *Peer, password []byte) (bool, error)
+	ConnectionCheckerContext func(ctx context.Context, peer *Peer) error
+	HeloCheckerContext       func(ctx context.Context, peer *Peer, name string) error
+	SenderCheckerContext     func(ctx context.Context, peer *Peer, addr *mail.Address) error
+	RecipientCheckerContext  func(ctx context.Context, peer *Peer, addr *mail.Address) error
 }
 
-// Auth sets the authentication function and authentication mechanisms which will be used
-func (srv *Server) Auth(f func(*Peer, []byte) (bool, error), mechanisms ...string) error {
-	if len(mechanisms) != 0 {
-		// Check that all authenticatedUser configured authentication mechanisms are support
-		for _, mech := range mechanisms {
-			if !stringInSlice(mech, SupportedAuthMechanisms) {
-				return fmt.Errorf("%v authentication mechanism is not supported", mech)
+// Auth sets the password authentication function and authentication mechanisms which will be offered,
+// PLAIN and LOGIN checking the password by f are used if no mechanisms are given
+func (srv *Server) Auth(f func(*Peer, []byte) (bool, error), mechanisms ...SASLMechanism) error {
+	if len(mechanisms) == 0 {
+		mechanisms = []SASLMechanism{PlainMechanism(srv.authenticate), LoginMechanism(srv.authenticate)}
+	}
+	for i, mech := range mechanisms {
+		for _, other := range mechanisms[:i] {
+			if strings.EqualFold(mech.Name(), other.Name()) {
+				return fmt.Errorf("%v authentication mechanism is registered twice", mech.Name())
 			}
 		}
-	} else {
-		mechanisms = SupportedAuthMechanisms
 	}
 	srv.authMechanisms = mechanisms
 	srv.Authenticator = f
 	return nil
 }
 
+// AuthContext is like Auth, but sets the context aware authentication function
+func (srv *Server) AuthContext(f func(context.Context, *Peer, []byte) (bool, error), mechanisms ...SASLMechanism) error {
+	if err := srv.Auth(nil, mechanisms...); err != nil {
+		return err
+	}
+	srv.AuthenticatorContext = f
+	return nil
+}
+
 /*
 NewServer creates new server
 */
@@ -90,6 +184,8 @@ func NewServer(port string, logger *log.Logger, limits ...Limits) (*Server, erro
 		Addr:         port,
 		log:          logger,
 		shuttingDown: false,
+
+		RateLimitStore: NewMemoryRateLimitStore(),
 	}
 	// limits are optional, if no limits were provided, use the default ones
 	if len(limits) == 1 {
@@ -103,23 +199,51 @@ func NewServer(port string, logger *log.Logger, limits ...Limits) (*Server, erro
 // ListenAndServe listens on the TCP network address and then
 // calls Serve to handle requests on incoming connections.
 // Connections are handled securely if it is available
+// If Listeners are configured, the server listens on all of them and returns
+// once any of them fails, after Shutdown or Close the returned error is ErrServerClosed
 func (srv *Server) ListenAndServe() error {
-	if srv.TLSConfig != nil {
-		l, err := tls.Listen("tcp", srv.Addr, srv.TLSConfig)
+	if len(srv.Listeners) == 0 {
+		l := srv.defaultListener(TLSImplicit)
+		ln, err := l.listen()
 		if err != nil {
 			return err
 		}
-		return srv.Serve(l)
+		return srv.serve(ln, l)
 	}
-	l, err := net.Listen("tcp", srv.Addr)
-	if err != nil {
-		return err
+
+	listeners := make([]*Listener, len(srv.Listeners))
+	lns := make([]net.Listener, 0, len(srv.Listeners))
+	for i := range srv.Listeners {
+		listeners[i] = srv.resolveListener(&srv.Listeners[i])
+		ln, err := listeners[i].listen()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+
+	errc := make(chan error, len(lns))
+	for i, ln := range lns {
+		go func(ln net.Listener, l *Listener) {
+			errc <- srv.serve(ln, l)
+		}(ln, listeners[i])
+	}
+	// first error stops all the other listeners
+	err := <-errc
+	for _, ln := range lns {
+		ln.Close()
 	}
-	return srv.Serve(l)
+	for i := 1; i < len(lns); i++ {
+		<-errc
+	}
+	return err
 }
 
 // Generate new context upon connection
-func (srv *Server) newSession(conn net.Conn) *session {
+func (srv *Server) newSession(ctx context.Context, conn net.Conn, l *Listener) *session {
 	id, err := gonanoid.Nanoid()
 	if err != nil {
 		// generating nanoid shouldn't really fail, and if, panicing is OK
@@ -134,6 +258,7 @@ func (srv *Server) newSession(conn net.Conn) *session {
 			bufio.NewWriter(conn),
 		),
 		srv:      srv,
+		listener: l,
 		envelope: NewEnvelope(),
 		start:    time.Now(),
 		log:      srv.log,
@@ -142,13 +267,9 @@ func (srv *Server) newSession(conn net.Conn) *session {
 			ServerName: srv.Hostname,
 		},
 	}
-
-	var tlsConn *tls.Conn
-	tlsConn, s.tls = conn.(*tls.Conn)
-	if s.tls {
-		state := tlsConn.ConnectionState()
-		s.peer.TLS = &state
-	}
+	s.ctx, s.cancel = newSessionContext(ctx, id, s.peer)
+	s.envelope.spoolThreshold = srv.SpoolThreshold
+	s.envelope.spoolDir = srv.SpoolDir
 
 	// set split function so it reads to new line or 1024 bytes max
 	return s
@@ -156,18 +277,159 @@ func (srv *Server) newSession(conn net.Conn) *session {
 
 // Serve incoming connections
 // Creates new session for each connection and starts go routine to handle it
+// Serve always returns non-nil error, after Shutdown or Close the returned error is ErrServerClosed
 func (srv *Server) Serve(ln net.Listener) error {
+	return srv.serve(ln, srv.defaultListener(TLSStartTLS))
+}
+
+// serve accepts connections on ln and serves them in the role given by the listener configuration
+func (srv *Server) serve(ln net.Listener, l *Listener) error {
+	if !srv.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
 	defer ln.Close()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if srv.isShuttingDown() {
+				return ErrServerClosed
+			}
 			if netError, ok := err.(net.Error); ok && netError.Temporary() {
 				srv.log.Printf("temporary accept error %s", err.Error())
 				continue
 			}
 			return err
 		}
-		s := srv.newSession(conn)
+		s := srv.newSession(context.Background(), conn, l)
+		srv.trackSession(s, true)
 		go s.Serve()
 	}
 }
+
+// ServeConn serves single SMTP session over the given connection and returns when the session ends.
+// The connection can be anything implementing net.Conn, e.g. one end of net.Pipe, Unix socket or
+// custom wrapper. The session is served in the same way as connections accepted by Serve.
+func (srv *Server) ServeConn(conn net.Conn) {
+	srv.ServeConnContext(context.Background(), conn)
+}
+
+// ServeConnContext is like ServeConn, but the connection is closed once the context is done
+func (srv *Server) ServeConnContext(ctx context.Context, conn net.Conn) {
+	s := srv.newSession(ctx, conn, srv.defaultListener(TLSStartTLS))
+	srv.trackSession(s, true)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.close()
+		case <-done:
+		}
+	}()
+	s.Serve()
+}
+
+// Shutdown gracefully shuts down the server without interrupting mail transactions.
+// It closes all listeners, replies 421 to idle sessions and closes them, and then waits
+// for sessions in the middle of DATA or BDAT to finish their transaction.
+// If the context expires first, the remaining connections are closed and the context's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.Lock()
+	srv.shuttingDown = true
+	err := srv.closeListenersLocked()
+	srv.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleSessions() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			srv.Lock()
+			for s := range srv.sessions {
+				s.close()
+			}
+			srv.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and all connections, including those in the middle
+// of mail transaction. For graceful shutdown use Shutdown.
+func (srv *Server) Close() error {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.shuttingDown = true
+	err := srv.closeListenersLocked()
+	for s := range srv.sessions {
+		s.close()
+	}
+	return err
+}
+
+func (srv *Server) isShuttingDown() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.shuttingDown
+}
+
+// trackListener adds or removes listener from the set of active listeners
+// returns false if the server is shutting down and the listener shouldn't be used
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown {
+			return false
+		}
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+// trackSession adds or removes session from the set of active sessions
+func (srv *Server) trackSession(s *session, add bool) {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+	}
+	if add {
+		srv.sessions[s] = struct{}{}
+	} else {
+		delete(srv.sessions, s)
+	}
+}
+
+func (srv *Server) closeListenersLocked() error {
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleSessions wakes up all sessions waiting for next command so they can
+// say goodbye to the client, returns true if there are no sessions left
+func (srv *Server) closeIdleSessions() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	for s := range srv.sessions {
+		s.interruptIfIdle()
+	}
+	return len(srv.sessions) == 0
+}
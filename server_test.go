@@ -1,31 +1,151 @@
 package gosmtp
 
 import (
-	"github.com/stretchr/testify/assert"
+	"context"
 	"log"
 	"net"
+	"net/textproto"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
-func init() {
-	srv, err := NewServer(":4343", log.New(os.Stdout, "", log.LstdFlags))
+func TestServer_Serve(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	addr, _ := startTestServer(t, srv)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err, "it should be possible to connect to the server")
+	if err == nil {
+		conn.Close()
+	}
+}
+
+// testCmd sends command and reads the response expecting given code
+func testCmd(c *textproto.Conn, expectCode int, line string) (int, string, error) {
+	id, err := c.Cmd("%s", line)
 	if err != nil {
-		panic(err)
+		return 0, "", err
 	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	return c.ReadResponse(expectCode)
+}
 
+// startTestServer starts given server on random local port and returns its address
+func startTestServer(t *testing.T, srv *Server) (string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
 	go func() {
-		err := srv.ListenAndServe()
-		if err != nil {
-			panic(err)
-		}
+		done <- srv.Serve(ln)
 	}()
+	return ln.Addr().String(), done
 }
 
-func TestServer_Serve(t *testing.T) {
-	conn, err := net.Dial("tcp", "localhost:4343")
-	assert.NoError(t, err, "it should be possible to connect to the server")
-	if err == nil {
-		conn.Close()
+func TestServer_Shutdown(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Handler = dummyHandle
+	srv.RecipientChecker = dummyChecker
+	addr, done := startTestServer(t, srv)
+
+	// idle session
+	idle, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, _, err = idle.ReadResponse(220)
+	assert.NoError(t, err)
+
+	// session in the middle of DATA
+	busy, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, _, err = busy.ReadResponse(220)
+	assert.NoError(t, err)
+	for _, c := range []struct {
+		cmd  string
+		code int
+	}{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<sender@localhost>", 250},
+		{"RCPT TO:<rcpt@localhost>", 250},
+		{"DATA", 354},
+	} {
+		_, _, err = testCmd(busy, c.code, c.cmd)
+		assert.NoError(t, err, c.cmd)
 	}
+	busy.PrintfLine("Subject: hello")
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	// idle session is closed with 421
+	_, _, err = idle.ReadResponse(250)
+	assert.Error(t, err)
+	assert.Equal(t, 421, err.(*textproto.Error).Code, "idle session should receive 421 upon shutdown")
+
+	// server stops accepting new connections
+	assert.Equal(t, ErrServerClosed, <-done)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "server shouldn't accept connections after shutdown")
+
+	// in-flight transaction can finish
+	busy.PrintfLine("")
+	busy.PrintfLine("Hello!")
+	busy.PrintfLine(".")
+	_, _, err = busy.ReadResponse(250)
+	assert.NoError(t, err, "transaction in progress should finish during shutdown")
+	_, _, err = busy.ReadResponse(250)
+	assert.Error(t, err)
+	assert.Equal(t, 421, err.(*textproto.Error).Code, "session should receive 421 after the transaction is done")
+
+	assert.NoError(t, <-shutdown)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Handler = dummyHandle
+	srv.RecipientChecker = dummyChecker
+	addr, _ := startTestServer(t, srv)
+
+	busy, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	busy.ReadResponse(220)
+	busy.PrintfLine("HELO localhost")
+	busy.ReadResponse(250)
+	busy.PrintfLine("MAIL FROM:<sender@localhost>")
+	busy.ReadResponse(250)
+	busy.PrintfLine("RCPT TO:<rcpt@localhost>")
+	busy.ReadResponse(250)
+	busy.PrintfLine("DATA")
+	busy.ReadResponse(354)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx), "shutdown should give up on expired context")
+
+	_, err = busy.ReadLine()
+	assert.Error(t, err, "connection should be closed after shutdown timeout")
+}
+
+func TestServer_Close(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	addr, done := startTestServer(t, srv)
+
+	conn, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	conn.ReadResponse(220)
+
+	assert.NoError(t, srv.Close())
+	assert.Equal(t, ErrServerClosed, <-done)
+	_, err = conn.ReadLine()
+	assert.Error(t, err, "connection should be closed by Close")
+	assert.Equal(t, ErrServerClosed, srv.ListenAndServe(), "closed server shouldn't serve again")
 }
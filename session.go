@@ -3,12 +3,17 @@ package gosmtp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/mail"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
@@ -21,7 +26,6 @@ const (
 	sessionStateGotRcpt
 	sessionStateReadyForData
 	sessionStateGettingData
-	sessionStateDataDone
 	sessionStateAborted
 	sessionStateWaitingForQuit
 )
@@ -32,6 +36,7 @@ type Protocol string
 const (
 	SMTP  Protocol = "SMTP"  // SMTP - plain old SMTP
 	ESMTP          = "ESMTP" // ESMTP - Extended SMTP
+	LMTP  Protocol = "LMTP"  // LMTP - Local Mail Transfer Protocol, RFC 2033
 )
 
 // Peer represents the client connecting to the server
@@ -39,16 +44,21 @@ type Peer struct {
 	HeloName        string
 	HeloType        string
 	Protocol        Protocol
+	RemoteName      string // client host name, if provided by XCLIENT or XFORWARD
 	ServerName      string
 	Username        string
+	AuthorizationID string // identity the authenticated Username acts as, allowed by Server.Authorizer, empty if it's the user itself
 	Authenticated   bool
 	Addr            net.Addr
 	TLS             *tls.ConnectionState
+	Proxy           *ProxyInfo // PROXY protocol information if the client connected through a proxy
 	AdditionalField map[string]interface{}
 }
 
 // session wraps underlying SMTP connection for easier handling
 type session struct {
+	mu    sync.Mutex        // guards conn and idle, which are accessed by the server during shutdown
+	idle  bool              // session is waiting for next command
 	conn  net.Conn          // connection
 	bufio *bufio.ReadWriter // buffered input/output
 	id    string            // email id
@@ -58,7 +68,7 @@ type session struct {
 	badCommandsCount int          // amount of bad commands
 	vrfyCount        int          // amount of vrfy commands received during current session
 	start            time.Time    // start time of the session
-	bodyType         string
+	readDeadline     time.Time    // current read deadline of conn
 
 	peer *Peer
 
@@ -71,12 +81,29 @@ type session struct {
 	helloHost string
 	helloSeen bool
 
-	log *log.Logger // logger
-	srv *Server     // serve handling this request
+	// XCLIENT and XFORWARD
+	xclientTrusted bool           // client is allowed to use XCLIENT and XFORWARD
+	xclientHelo    bool           // HELO name was set by XCLIENT
+	xclientProto   bool           // protocol was set by XCLIENT
+	forwarded      *forwardedPeer // peer info before XFORWARD, restored after the transaction
+
+	rateCharged map[string]bool // rate limits already charged for the session start
+
+	ctx    context.Context    // context of the session lifetime, passed to hooks
+	cancel context.CancelFunc // cancels ctx once the session ends
+
+	stream  *messageStream  // message being passed to StreamHandler
+	body    *eightBitWriter // writer of the message data, see messageWriter
+	chunked int64           // size of BDAT chunks received in current transaction
+
+	log      *log.Logger // logger
+	srv      *Server     // serve handling this request
+	listener *Listener   // configuration of the listener which accepted the connection
 }
 
 // Reset resets current session, happens upon MAIL, EHLO, HELO and RSET
 func (s *session) Reset() {
+	s.discardMessage(errTransactionReset)
 	s.envelope.Reset()
 	s.state = sessionStateInit
 }
@@ -87,16 +114,30 @@ func (s *session) ReadLine() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	// trim \r\n
-	return input[:len(input)-2], nil
+	// trim \r\n, bare \n must not panic
+	return strings.TrimSuffix(strings.TrimSuffix(input, "\n"), "\r"), nil
+}
+
+// replyError sends reply of the Error returned by a hook, fallback reply is sent for other errors
+func (s *session) replyError(err error, fallback string) {
+	var smtpErr *Error
+	if errors.As(err, &smtpErr) {
+		s.Out(smtpErr.Error())
+		return
+	}
+	s.Out(fallback)
 }
 
 func (s *session) Out(msgs ...string) {
 	// log
 	s.log.Printf("INFO: returning msg: '%v'", msgs)
 
-	s.conn.SetWriteDeadline(time.Now().Add(DefaultLimits.ReplyOut))
+	s.conn.SetWriteDeadline(time.Now().Add(s.listener.Limits.ReplyOut))
+	strip := !s.extensionEnabled(ExtEnhancedStatusCodes)
 	for _, msg := range msgs {
+		if strip {
+			msg = stripEnhancedCode(msg)
+		}
 		s.bufio.WriteString(msg)
 		s.bufio.Write([]byte("\r\n"))
 	}
@@ -106,25 +147,148 @@ func (s *session) Out(msgs ...string) {
 	}
 }
 
+// setIdle marks whether the session is waiting for the next command
+func (s *session) setIdle(idle bool) {
+	s.mu.Lock()
+	s.idle = idle
+	s.mu.Unlock()
+}
+
+// interruptIfIdle interrupts read of the next command if the session is idle
+func (s *session) interruptIfIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle {
+		s.conn.SetReadDeadline(time.Unix(1, 0))
+	}
+}
+
+// setConn replaces underlying connection, e.g. after STARTTLS
+func (s *session) setConn(conn net.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	s.bufio = bufio.NewReadWriter(
+		bufio.NewReader(conn),
+		bufio.NewWriter(conn),
+	)
+}
+
+// setReadDeadline sets read deadline of the connection, it's remembered so it can be restored by watchDisconnect
+func (s *session) setReadDeadline(t time.Time) {
+	s.readDeadline = t
+	s.conn.SetReadDeadline(t)
+}
+
+// setDeadline sets read and write deadlines of the connection
+func (s *session) setDeadline(t time.Time) {
+	s.readDeadline = t
+	s.conn.SetDeadline(t)
+}
+
+// close closes the underlying connection
+func (s *session) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Close()
+}
+
 // Serve - serve given session
 // scans command from input and handles given commands accordingly, any failure will result to immediate abort
 // of connection
 func (s *session) Serve() {
-	defer s.conn.Close()
+	defer s.srv.trackSession(s, false)
+	defer s.close()
+	defer s.cancel()
+	defer s.envelope.Reset()
+	defer s.discardMessage(io.ErrUnexpectedEOF)
+
+	// server is going down, don't even start
+	if s.srv.isShuttingDown() {
+		s.Out(Codes.ErrorShutdown)
+		return
+	}
+
+	// concurrent sessions limits, the session is counted before anything is read from the client,
+	// so clients stalling the PROXY header or TLS handshake hold the slot too
+	proxied := s.listener.ProxyProtocol && addrInNetworks(s.conn.RemoteAddr(), s.listener.TrustedProxies)
+	var ip net.IP
+	if !proxied {
+		host, _ := splitHostPort(s.peer.Addr)
+		ip = net.ParseIP(host)
+	}
+	if !s.srv.conns.acquire(ip, s.listener.Limits) {
+		s.rejectConnection()
+		return
+	}
+	defer func() { s.srv.conns.release(ip, s.listener.Limits) }()
+
+	// connection from trusted proxy, the real client address comes in the PROXY header
+	if proxied {
+		if err := s.handleProxyHeader(); err != nil {
+			s.log.Printf("ERROR: proxy protocol from %s: '%s'", s.conn.RemoteAddr(), err.Error())
+			return
+		}
+		// the session is counted in total only until the client address is known
+		host, _ := splitHostPort(s.peer.Addr)
+		if clientIP := net.ParseIP(host); clientIP != nil {
+			if !s.srv.conns.acquireIP(clientIP, s.listener.Limits) {
+				s.rejectConnection()
+				return
+			}
+			ip = clientIP
+		}
+	}
+
+	s.xclientTrusted = addrInNetworks(s.peer.Addr, s.srv.TrustedNetworks)
+
+	// implicit TLS, finish the handshake before greeting the client
+	if _, ok := s.conn.(*tls.Conn); !ok && s.listener.TLSMode == TLSImplicit {
+		s.setConn(tls.Server(s.conn, s.listener.TLSConfig))
+	}
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		s.setDeadline(time.Now().Add(s.listener.Limits.TLSSetup))
+		if err := tlsConn.Handshake(); err != nil {
+			s.log.Printf("ERROR: tls handshake: '%s'", err.Error())
+			return
+		}
+		s.setDeadline(time.Time{})
+		s.tls = true
+		s.tlsState = tlsConn.ConnectionState()
+		s.peer.TLS = &s.tlsState
+		s.certificateAuth()
+	}
+
+	if !s.rateAllowSession(s.rateLimits("")) {
+		s.Out(Codes.ErrorRateLimitConnection)
+		s.state = sessionStateAborted
+		return
+	}
 
 	// send welcome
 	s.handleWelcome()
 
 	// for each received command
 	for {
+		// let the client know we are leaving, in-flight transaction is done by now
+		if s.srv.isShuttingDown() {
+			s.Out(Codes.ErrorShutdown)
+			break
+		}
 		// TODO can we?
-		if s.badCommandsCount >= s.srv.Limits.BadCmds {
+		if s.badCommandsCount >= s.listener.Limits.BadCmds {
 			s.Out(Codes.FailMaxUnrecognizedCmd)
 			s.state = sessionStateAborted
 			break
 		}
+		s.setIdle(true)
 		line, err := s.ReadLine()
+		s.setIdle(false)
 		if err != nil {
+			if s.srv.isShuttingDown() {
+				s.Out(Codes.ErrorShutdown)
+				break
+			}
 			s.log.Printf("ERROR: %s", err.Error())
 			break
 		}
@@ -148,13 +312,39 @@ func (s *session) Serve() {
 			break
 		}
 		// TODO timeout might differ as per https://tools.ietf.org/html/rfc5321#section-4.5.3.2
-		s.conn.SetReadDeadline(time.Now().Add(s.srv.Limits.CmdInput))
+		s.setReadDeadline(time.Now().Add(s.listener.Limits.CmdInput))
+	}
+}
+
+// handleProxyHeader reads PROXY protocol header and replaces peer address with the original client address
+func (s *session) handleProxyHeader() error {
+	s.setReadDeadline(time.Now().Add(s.listener.Limits.CmdInput))
+	// read directly from the connection, nothing past the header may be buffered
+	info, err := readProxyHeader(s.conn)
+	if err != nil {
+		return err
+	}
+	s.setReadDeadline(time.Time{})
+	if info != nil {
+		s.log.Printf("INFO: proxied connection from %s via %s", info.SourceAddr, s.conn.RemoteAddr())
+		s.peer.Proxy = info
+		s.peer.Addr = info.SourceAddr
 	}
+	return nil
 }
 
 // send Welcome upon new session creation
 func (s *session) handleWelcome() {
-	s.Out(fmt.Sprintf("220 %s ESMTP gomstp(0.0.1) I'm mr. Meeseeks, look at me!", s.peer.ServerName))
+	if err := s.checkConnection(); err != nil {
+		s.replyError(err, "554 "+err.Error())
+		s.state = sessionStateWaitingForQuit
+		return
+	}
+	var proto Protocol = ESMTP
+	if s.listener.LMTP {
+		proto = LMTP
+	}
+	s.Out(fmt.Sprintf("220 %s %s gomstp(0.0.1) I'm mr. Meeseeks, look at me!", s.peer.ServerName, proto))
 	/*
 		The SMTP protocol allows a server to formally reject a mail session
 		while still allowing the initial connection as follows: a 554
@@ -172,72 +362,84 @@ func (s *session) handleWelcome() {
 
 // handle Ehlo command
 func handleEhlo(s *session, cmd *command) {
+	if s.listener.LMTP {
+		s.Out(Codes.FailUnrecognizedCmd)
+		s.badCommandsCount++
+		return
+	}
+	s.ehlo(cmd, ESMTP)
+}
+
+// ehlo greets the client and lists the extensions, shared by EHLO and LHLO
+func (s *session) ehlo(cmd *command, proto Protocol) {
 	s.Reset()
 
 	s.helloSeen = true
 	s.helloType = cmd.commandCode
 	// TODO chec cmd args
+	if len(cmd.arguments) == 0 {
+		s.Out(Codes.FailMissingArgument)
+		return
+	}
 	s.helloHost = cmd.arguments[0]
+	s.setHelo(cmd, proto)
 	// TODO check sending host (SPF)
-	if s.srv.HeloChecker != nil {
-		if err := s.srv.HeloChecker(s.peer, s.helloHost); err != nil {
-			s.Out("550 " + err.Error())
-		}
+	if err := s.checkHelo(s.helloHost); err != nil {
+		s.replyError(err, "550 "+err.Error())
+		s.helloSeen = false
+		return
 	}
 
-	ehloResp := make([]string, 0, 10)
-
-	ehloResp = append(ehloResp, fmt.Sprintf("250-%v hello %v", "mail.example", s.conn.RemoteAddr()))
-	// https://tools.ietf.org/html/rfc6152
-	ehloResp = append(ehloResp, "250-8BITMIME")
-	// https://tools.ietf.org/html/rfc3030
-	ehloResp = append(ehloResp, "250-CHUNKING")
-	ehloResp = append(ehloResp, "250-BINARYMIME")
-	// https://tools.ietf.org/html/rfc6531
-	ehloResp = append(ehloResp, "250-SMTPUTF8")
-	// https://tools.ietf.org/html/rfc2920
-	ehloResp = append(ehloResp, "250-PIPELINING")
-	// https://tools.ietf.org/html/rfc6710
-	ehloResp = append(ehloResp, "250-MT-PRIORITY")
-	// https://tools.ietf.org/html/rfc3207
-	if s.srv.TLSConfig != nil { // do tls for this server
-		if !s.tls { // already in tls stream
-			ehloResp = append(ehloResp, "250-STARTTLS")
+	extensions := s.extensionLines()
+	ehloResp := make([]string, 0, len(extensions)+1)
+	ehloResp = append(ehloResp, fmt.Sprintf("%v hello %v", s.peer.ServerName, s.peer.Addr))
+	ehloResp = append(ehloResp, extensions...)
+	for i := range ehloResp {
+		if i == len(ehloResp)-1 {
+			ehloResp[i] = "250 " + ehloResp[i]
+		} else {
+			ehloResp[i] = "250-" + ehloResp[i]
 		}
 	}
-	// https://tools.ietf.org/html/rfc4954
-	/*
-		RFC4954 notes: A server implementation MUST
-		implement a configuration in which it does NOT
-		permit any plaintext password mechanisms, unless
-		either the STARTTLS [SMTP-TLS] command has been negotiated...
-	*/
-	if len(s.srv.authMechanisms) != 0 && s.srv.TLSConfig != nil {
-		ehloResp = append(ehloResp, "250-AUTH "+strings.Join(s.srv.authMechanisms, " "))
-	}
-	// https://tools.ietf.org/html/rfc821
-	ehloResp = append(ehloResp, "250-HELP")
-	// https://tools.ietf.org/html/rfc1870
-	ehloResp = append(ehloResp, "250 SIZE 35882577") // from gmail TODO
-
 	s.Out(ehloResp...)
 }
 
+// setHelo updates peer with HELO/EHLO information, unless it was provided by XCLIENT
+func (s *session) setHelo(cmd *command, proto Protocol) {
+	s.peer.HeloType = strings.ToUpper(cmd.verb)
+	if !s.xclientHelo {
+		s.peer.HeloName = s.helloHost
+	}
+	if !s.xclientProto {
+		s.peer.Protocol = proto
+	}
+}
+
 // handle Helo command
 func handleHelo(s *session, cmd *command) {
+	if s.listener.LMTP {
+		s.Out(Codes.FailUnrecognizedCmd)
+		s.badCommandsCount++
+		return
+	}
 	s.Reset()
 	s.helloSeen = true
 	s.helloType = cmd.commandCode
 	// TODO check cmd args
+	if len(cmd.arguments) == 0 {
+		s.Out(Codes.FailMissingArgument)
+		return
+	}
 	s.helloHost = cmd.arguments[0]
+	s.setHelo(cmd, SMTP)
 	// TODO check sending host (SPF)
-	if s.srv.HeloChecker != nil {
-		if err := s.srv.HeloChecker(s.peer, s.helloHost); err != nil {
-			s.Out("550 " + err.Error())
-		}
+	if err := s.checkHelo(s.helloHost); err != nil {
+		s.replyError(err, "550 "+err.Error())
+		s.helloSeen = false
+		return
 	}
 
-	s.Out(fmt.Sprintf("250 %v hello %v", "mail.example", s.conn.RemoteAddr()))
+	s.Out(fmt.Sprintf("250 %v hello %v", s.peer.ServerName, s.peer.Addr))
 }
 
 // start TLS
@@ -249,16 +451,17 @@ func handleStartTLS(s *session, cmd *command) {
 		return
 	}
 
-	if s.srv.TLSConfig == nil {
+	if !s.extensionEnabled(ExtStartTLS) {
 		s.Out(Codes.FailCmdNotSupported)
+		s.badCommandsCount++
 		return
 	}
 
 	s.Out(Codes.SuccessStartTLSCmd)
 
 	// set timeout for TLS connection negotiation
-	s.conn.SetDeadline(time.Now().Add(DefaultLimits.TLSSetup))
-	secureConn := tls.Server(s.conn, s.srv.TLSConfig)
+	s.setDeadline(time.Now().Add(s.listener.Limits.TLSSetup))
+	secureConn := tls.Server(s.conn, s.listener.TLSConfig)
 
 	// TLS handshake
 	if err := secureConn.Handshake(); err != nil {
@@ -270,15 +473,12 @@ func handleStartTLS(s *session, cmd *command) {
 
 	// reset session
 	s.Reset()
-	s.conn = secureConn
-	s.bufio = bufio.NewReadWriter(
-		bufio.NewReader(s.conn),
-		bufio.NewWriter(s.conn),
-	)
+	s.setConn(secureConn)
 	s.tls = true
 	s.tlsState = secureConn.ConnectionState()
 	s.peer.TLS = &s.tlsState
 	s.state = sessionStateInit
+	s.certificateAuth()
 }
 
 func handleMail(s *session, cmd *command) {
@@ -289,122 +489,163 @@ func handleMail(s *session, cmd *command) {
 	*/
 	s.Reset()
 
-	if !s.tls && s.srv.TLSOnly {
+	if !s.tls && s.listener.RequireTLS {
 		s.Out(Codes.FailEncryptionNeeded)
 		return
 	}
 
 	// require authentication if set in settings
-	if len(s.srv.authMechanisms) != 0 && !s.peer.Authenticated {
+	if s.listener.RequireAuth && !s.peer.Authenticated {
 		s.Out(Codes.FailAccessDenied)
 		return
 	}
 
-	// nested mail command
-	if s.envelope.IsSet() {
-		s.Out(Codes.FailNestedMailCmd)
+	// LMTP has no MAIL before LHLO leniency
+	if s.listener.LMTP && !s.helloSeen {
+		s.Out(Codes.FailBadSequence)
 		return
 	}
 
-	args := cmd.arguments
-	if len(args) == 0 {
-		s.log.Print("DEBUG: Empty arguments for MAIL cmd")
-		s.Out(Codes.FailInvalidAddress)
+	// nested mail command
+	if s.envelope.IsSet() {
+		s.Out(Codes.FailNestedMailCmd)
 		return
 	}
 
-	// to lower and check if start with from: and is not empty
-	from := strings.ToLower(strings.TrimSpace(args[0]))
-	if from == "" || !strings.HasPrefix(from, "from:") {
+	arg := cmd.argument()
+	if len(arg) < 5 || !strings.EqualFold(arg[:5], "FROM:") {
 		s.log.Print("DEBUG: Invalid address for MAIL cmd")
 		s.Out(Codes.FailInvalidAddress)
 		return
 	}
 
-	fromParts := strings.Split(from, ":")
-	if len(fromParts) < 2 {
-		s.Out(Codes.FailInvalidAddress)
+	mailbox, params, err := parseReversePath(arg[5:])
+	if err == nil {
+		// https://tools.ietf.org/html/rfc6531
+		_, smtputf8 := params["SMTPUTF8"]
+		mailbox, err = normalizeMailbox(mailbox, smtputf8)
+	}
+	if err != nil {
+		s.Out(pathErrorReply(err, Codes.FailBadSenderMailboxAddressSyntax))
 		return
 	}
+	// the null reverse-path <> has empty address
+	mailFrom := &mail.Address{Address: mailbox}
 
-	mailFrom, err := parseAddress(fromParts[1])
-	if err != nil {
-		s.Out(Codes.FailInvalidAddress)
+	if err := s.checkSender(mailFrom); err != nil {
+		s.replyError(err, Codes.FailAccessDenied+" "+err.Error())
 		return
 	}
 
-	if s.srv.SenderChecker != nil {
-		if err := s.srv.SenderChecker(s.peer, mailFrom); err != nil {
-			s.Out(Codes.FailAccessDenied + " " + err.Error())
+	// extensions
+	var dsn DSN
+	var bodyType BodyType
+	var auth string
+	for keyword, value := range params {
+		if !s.paramEnabled(keyword) {
+			s.Out(Codes.FailParameterNotRecognized)
 			return
 		}
-	}
-
-	s.envelope.MailFrom = mailFrom
-	args = args[1:]
-
-	// extensions size
-	if len(args) > 0 {
-		for _, ext := range args {
-			extValue := strings.Split(ext, "=")
-			if len(extValue) != 2 {
-				s.Out(Codes.FailInvalidAddress)
+		switch keyword {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				s.Out(Codes.FailInvalidExtension)
+				return
+			}
+			if limit := s.listener.Limits.MsgSize; limit > 0 && size > limit {
+				s.Out(Codes.FailTooBig)
+				return
+			}
+		case "BODY":
+			// body-value ::= "7BIT" / "8BITMIME" / "BINARYMIME"
+			if bodyType, err = parseBodyType(value); err != nil {
+				s.Out(Codes.FailInvalidExtension)
+				return
+			}
+			if bodyType == BodyTypeBinaryMIME && !s.extensionEnabled(ExtBinaryMIME) {
+				s.Out(Codes.FailParameterNotRecognized)
+				return
+			}
+		case "SMTPUTF8":
+			// https://tools.ietf.org/html/rfc6531, the parameter has no value
+			if value != "" {
+				s.Out(Codes.FailInvalidExtension)
+				return
+			}
+		case "ALT-ADDRESS":
+			/*
+			   One optional parameter, ALT-ADDRESS, is added to the MAIL and
+			   RCPT commands of SMTP.  ALT-ADDRESS specifies an all-ASCII
+			   address which can be used as a substitute for the corresponding
+			   primary (i18mail) address when downgrading.
+			*/
+		case "AUTH":
+			/*
+				An optional parameter using the keyword "AUTH" is added to the
+				MAIL FROM command, and extends the maximum line length of the
+				MAIL FROM command by 500 characters.
+
+				If the server does not sufficiently trust the authenticated identity of the
+				client, or if the client is not authenticated, then the server MUST behave as
+				if the AUTH=<> parameter was supplied.
+			*/
+			if auth, err = parseMailAuth(value); err != nil {
+				s.Out(Codes.FailInvalidExtension)
+				return
+			}
+			if !s.peer.Authenticated {
+				auth = ""
+			}
+		case "MT-PRIORITY":
+			/*
+				https://tools.ietf.org/html/rfc6710
+			*/
+			priority, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				s.Out(Codes.FailInvalidExtension)
 				return
 			}
-			switch strings.ToUpper(extValue[0]) {
-			case "SIZE":
-				size, err := strconv.ParseInt(extValue[1], 10, 64)
-				if err != nil {
-					s.Out(Codes.FailInvalidExtension)
-					return
-				}
-				if int64(size) > DefaultLimits.MsgSize {
-					s.Out(Codes.FailTooBig)
-					return
-				}
-			case "BODY":
-				// body-value ::= "7BIT" / "8BITMIME" / "BINARYMIME"
-				s.bodyType = extValue[1]
-			case "ALT-ADDRESS":
-				/*
-				   One optional parameter, ALT-ADDRESS, is added to the MAIL and
-				   RCPT commands of SMTP.  ALT-ADDRESS specifies an all-ASCII
-				   address which can be used as a substitute for the corresponding
-				   primary (i18mail) address when downgrading.
-				*/
-			case "AUTH":
-				/*
-					An optional parameter using the keyword "AUTH" is added to the
-					MAIL FROM command, and extends the maximum line length of the
-					MAIL FROM command by 500 characters.
-				*/
-			case "MT-PRIORITY":
-				/*
-					https://tools.ietf.org/html/rfc6710
-				*/
-				priority, err := strconv.ParseInt(extValue[1], 10, 64)
-				if err != nil {
-					s.Out(Codes.FailInvalidExtension)
-					return
-				}
-				if priority > 9 || priority < -9 {
-					s.Out(Codes.FailInvalidExtension)
-					return
-				}
-				s.envelope.Priority = int(priority)
-			default:
-				s.Out("555")
-				s.envelope.MailFrom = nil
+			if priority > 9 || priority < -9 {
+				s.Out(Codes.FailInvalidExtension)
+				return
+			}
+			s.envelope.Priority = int(priority)
+		case "RET":
+			// https://tools.ietf.org/html/rfc3461#section-4.3
+			if dsn.Return, err = parseDSNReturn(value); err != nil {
+				s.Out(Codes.FailInvalidExtension)
+				return
+			}
+		case "ENVID":
+			// https://tools.ietf.org/html/rfc3461#section-4.4
+			if dsn.EnvelopeID, err = parseDSNEnvelopeID(value); err != nil {
+				s.Out(Codes.FailInvalidExtension)
+				return
 			}
+		default:
+			s.Out(Codes.FailParameterNotRecognized)
+			return
 		}
 	}
 
 	// validate FQN
-	if err := IsFQN(s.envelope.MailFrom); err != "" {
+	if err := IsFQN(mailFrom); err != "" {
 		s.Out(err)
 		return
 	}
 
+	limits := s.rateLimits(hostname(mailFrom))
+	if !s.rateAllowSession(limits) || !s.rateAllow(rateMessages, limits) {
+		s.Out(Codes.ErrorRateLimit)
+		return
+	}
+	s.envelope.MailFrom = mailFrom
+	s.envelope.DSN = dsn
+	s.envelope.BodyType = bodyType
+	s.envelope.Auth = auth
+	_, s.envelope.SMTPUTF8 = params["SMTPUTF8"]
+
 	switch s.state {
 	case sessionStateGotRcpt:
 		s.state = sessionStateReadyForData
@@ -420,7 +661,7 @@ func handleMail(s *session, cmd *command) {
 
 func handleRcpt(s *session, cmd *command) {
 	// if auth is required
-	if len(s.srv.authMechanisms) != 0 && !s.peer.Authenticated {
+	if s.listener.RequireAuth && !s.peer.Authenticated {
 		s.Out(Codes.FailAccessDenied)
 		return
 	}
@@ -432,76 +673,79 @@ func handleRcpt(s *session, cmd *command) {
 	}
 
 	// check recipients limit
-	if len(s.envelope.MailTo) > DefaultLimits.MaxRcptCount {
+	if len(s.envelope.MailTo) > s.listener.Limits.MaxRcptCount {
 		s.Out(Codes.ErrorTooManyRecipients)
 		return
 	}
 
-	args := cmd.arguments
-	if args == nil {
+	arg := cmd.argument()
+	if len(arg) < 3 || !strings.EqualFold(arg[:3], "TO:") {
 		s.Out(Codes.FailInvalidRecipient)
-	}
-
-	toParts := strings.Split(args[0], ":")
-	if len(toParts) < 2 || strings.ToUpper(strings.TrimSpace(toParts[0])) != "TO" {
-		s.Out(Codes.FailInvalidAddress)
 		return
 	}
 
-	/*
-		TODO
-		Servers MUST be prepared to encounter a list of source
-		routes in the forward-path, but they SHOULD ignore the routes or MAY
-		decline to support the relaying they imply.
-	*/
-	// must be implemented - RFC5321
-	if strings.ToLower(toParts[1]) == "<postmaster>" {
-		toParts[1] = "<postmaster@" + s.peer.ServerName + ">"
+	// source routes in the forward-path are ignored by the parser as RFC 5321 recommends
+	mailbox, params, err := parseForwardPath(arg[3:])
+	if err == nil {
+		mailbox, err = normalizeMailbox(mailbox, s.envelope.SMTPUTF8)
 	}
-
-	rcpt, err := parseAddress(toParts[1])
 	if err != nil {
-		s.Out(Codes.FailInvalidAddress)
+		s.Out(pathErrorReply(err, Codes.FailBadDestinationMailboxAddressSyntax))
 		return
 	}
+	// must be implemented - RFC5321
+	if mailbox == "postmaster" && s.peer.ServerName != "" {
+		mailbox = "postmaster@" + s.peer.ServerName
+	}
+	rcpt := &mail.Address{Address: mailbox}
 
 	// check valid recipient if this email comes from outside
-	err = s.srv.RecipientChecker(s.peer, rcpt)
-	if err != nil {
-		if err == ErrorRecipientNotFound {
-			s.Out(Codes.FailMailboxDoesntExist)
-			return
-		}
-		if err == ErrorRecipientsMailboxFull {
-			s.Out(Codes.FailMailboxFull)
-			return
-		}
-		s.Out(Codes.FailAccessDenied)
+	if err := s.checkRecipient(rcpt); err != nil {
+		s.replyError(err, Codes.FailAccessDenied)
 		return
 	}
 
-	// extensions size
-	if len(args) > 0 {
-		for _, ext := range args {
-			extValue := strings.Split(ext, "=")
-			if len(extValue) != 2 {
-				s.Out(Codes.FailInvalidAddress)
+	// extensions
+	var dsn RecipientDSN
+	for keyword, value := range params {
+		if !s.paramEnabled(keyword) {
+			s.Out(Codes.FailParameterNotRecognized)
+			return
+		}
+		switch keyword {
+		case "RRVS":
+			// https://tools.ietf.org/html/rfc7293
+			since, err := time.Parse(time.RFC3339, value)
+			s.log.Printf("INFO: client requested Require-Recipient-Valid-Since check: %#v %#v\n", since, err)
+		case "NOTIFY":
+			// https://tools.ietf.org/html/rfc3461#section-4.1
+			if dsn.Notify, err = parseDSNNotify(value); err != nil {
+				s.Out(Codes.FailInvalidExtension)
 				return
 			}
-			switch strings.ToUpper(extValue[0]) {
-			case "RRVS":
-				// https://tools.ietf.org/html/rfc7293
-				since, err := time.Parse(time.RFC3339, extValue[1])
-				s.log.Printf("INFO: client requested Require-Recipient-Valid-Since check: %#v %#v\n", since, err)
-			default:
-				s.Out("555")
-				s.envelope.MailFrom = nil
+		case "ORCPT":
+			// https://tools.ietf.org/html/rfc3461#section-4.2
+			if dsn.OriginalRecipientType, dsn.OriginalRecipient, err = parseDSNOriginalRecipient(value); err != nil {
+				s.Out(Codes.FailInvalidExtension)
+				return
 			}
+		default:
+			s.Out(Codes.FailParameterNotRecognized)
+			return
 		}
 	}
 
+	senderDomain := ""
+	if s.envelope.MailFrom != nil {
+		senderDomain = hostname(s.envelope.MailFrom)
+	}
+	if !s.rateAllow(rateRecipients, s.rateLimits(senderDomain)) {
+		s.Out(Codes.ErrorRateLimit)
+		return
+	}
+
 	// Add to recipients
-	err = s.envelope.AddRecipient(rcpt)
+	err = s.envelope.addRecipient(rcpt, dsn)
 	if err != nil {
 		s.Out(err.Error())
 		return
@@ -542,7 +786,7 @@ func handleVrfy(s *session, _ *command) {
 }
 
 func handleData(s *session, cmd *command) {
-	if s.bodyType == "BINARYMIME" {
+	if s.envelope.BodyType == BodyTypeBinaryMIME || s.state == sessionStateGettingData {
 		/*
 			https://tools.ietf.org/html/rfc3030
 			BINARYMIME cannot be used with the DATA command.  If a DATA command
@@ -550,9 +794,12 @@ func handleData(s *session, cmd *command) {
 			"BINARYMIME", a 503 "Bad sequence of commands" response MUST be sent.
 			The resulting state from this error condition is indeterminate and
 			the transaction MUST be reset with the RSET command.
+
+			DATA and BDAT commands cannot be used in the same transaction.  If a
+			DATA statement is issued after a BDAT for the current transaction, a
+			503 "Bad sequence of commands" MUST be issued.
 		*/
 		s.Out(Codes.FailBadSequence)
-		s.state = sessionStateAborted
 		return
 	}
 
@@ -573,67 +820,49 @@ func handleData(s *session, cmd *command) {
 	}
 
 	// set data input time limit
-	s.conn.SetReadDeadline(time.Now().Add(DefaultLimits.MsgInput))
-
-	// TODO https://tools.ietf.org/html/rfc5321#section-4.5.3.1.6
-	// read data, stop on EOF or reaching maximum sizes
-	var size int64
-	for size < s.srv.Limits.MsgSize {
-		line, err := s.bufio.ReadString('\n')
-		if err != nil {
-			s.Out(fmt.Sprintf(Codes.FailReadErrorDataCmd, err))
-			s.state = sessionStateAborted
-			return
-		}
-		line = strings.TrimSpace(line)
-		if line == "." {
-			break
-		}
-		size += int64(len(line))
-		s.envelope.WriteString(line)
-		s.envelope.Write([]byte("\r\n"))
-	}
-
-	// reading ended by reaching maximum size
-	if size > s.srv.Limits.MsgSize {
+	s.setReadDeadline(time.Now().Add(s.listener.Limits.MsgInput))
+
+	// read data till the terminating <CRLF>.<CRLF>, the rest of too big message is discarded
+	s.beginMessage()
+	_, err := readData(s.bufio.Reader, s.messageWriter(), s.listener.Limits.MsgSize, s.srv.BareLineEndings)
+	switch err {
+	case nil, errStreamClosed:
+		// stream handler which returned early decides the result itself
+	case errMessageTooBig:
+		s.discardMessage(err)
 		s.Out(Codes.FailTooBig)
+		s.resetForwarded()
+		s.Reset()
+		return
+	case errBareLineEnding:
+		s.discardMessage(err)
+		s.Out(Codes.FailBareLineEnding)
+		s.resetForwarded()
+		s.Reset()
+		return
+	default:
+		s.discardMessage(err)
+		s.Out(fmt.Sprintf(Codes.FailReadErrorDataCmd, err))
+		s.state = sessionStateAborted
 		return
-	}
-
-	// add received header
-	/*
-		When forwarding a message into or out of the Internet environment, a
-		gateway MUST prepend a Received: line, but it MUST NOT alter in any
-		way a Received: line that is already in the header section.
-	*/
-	s.envelope.headers["Received"] = string(s.ReceivedHeader())
-
-	// add Message-ID, is user is aut
-	if s.peer.Authenticated {
-		s.envelope.headers["Message-ID"] = fmt.Sprintf("Message-ID: <%d.%s@%s>\r\n", time.Now().Unix(), s.id, s.peer.ServerName)
 	}
 
 	// data done
-	s.envelope.Close()
 	s.state = sessionStateWaitingForQuit
 
 	// add envelope to delivery system
-	id, err := s.srv.Handler(s.peer, s.envelope)
-	if err != nil {
-		s.Out("451 temporary queue error")
-	} else {
-		s.Out(fmt.Sprintf("%v %s", Codes.SuccessMessageQueued, id))
-	}
+	s.deliverMessage()
 
 	// reset session
+	s.resetForwarded()
 	s.Reset()
 	return
 }
 
 // handleRset handle reset commands, reset currents session to beginning and empties the envelope
 func handleRset(s *session, _ *command) {
-	s.envelope.Reset()
-	s.state = sessionStateInit
+	s.resetForwarded()
+	s.Reset()
 	s.Out(Codes.SuccessResetCmd)
 }
 
@@ -658,37 +887,33 @@ func handleHelp(s *session, _ *command) {
 	s.Out(Codes.SuccessHelpCmd + " CaN yOu HelP Me PLeasE!")
 }
 func handleBdat(s *session, cmd *command) {
-	args := cmd.arguments
-
-	if s.state == sessionStateDataDone {
-		/*
-			Any BDAT command sent after the BDAT LAST is illegal and
-			MUST be replied to with a 503 "Bad sequence of commands" reply code.
-			The state resulting from this error is indeterminate.  A RSET command
-			MUST be sent to clear the transaction before continuing.
-		*/
-		s.Out("503 Bad sequence of commands")
+	if !s.extensionEnabled(ExtChunking) {
+		s.Out(Codes.FailCmdNotSupported)
+		s.badCommandsCount++
 		return
 	}
+	/*
+		https://tools.ietf.org/html/rfc3030
 
-	last := false
-	if len(args) == 0 {
-		s.Out(Codes.FailUnrecognizedCmd) // TODO use the right code
-		return
+		bdat-cmd   ::= "BDAT" SP chunk-size [ SP end-marker ] CR LF
+		chunk-size ::= 1*DIGIT
+		end-marker ::= "LAST"
+	*/
+	args := cmd.arguments
+	var size int64
+	var err error
+	if len(args) > 0 {
+		size, err = strconv.ParseInt(args[0], 10, 64)
 	}
-
-	chunkSize64, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		s.Out(Codes.FailUnrecognizedCmd) // TODO use the right code
-		s.badCommandsCount++
+	if len(args) == 0 || err != nil || size < 0 || strings.IndexFunc(args[0], notDigit) >= 0 {
+		// the amount of data following the command is unknown, the session can't continue
+		s.Out(Codes.FailInvalidBdatCmd)
+		s.state = sessionStateAborted
 		return
 	}
+	last := len(args) == 2 && strings.ToUpper(args[1]) == "LAST"
+	s.log.Printf("INFO: received BDAT command, last: %t, data length: %d", last, size)
 
-	if (len(args) > 1 && strings.ToUpper(args[1]) == "LAST") || chunkSize64 == 0 {
-		last = true
-	}
-
-	s.log.Printf("INFO: received BDAT command, last: %t, data length: %d", last, chunkSize64)
 	/*
 		The message data is sent immediately after the trailing <CR>
 		<LF> of the BDAT command line.  Once the receiver-SMTP receives the
@@ -698,61 +923,106 @@ func handleBdat(s *session, cmd *command) {
 		received, the receiver-SMTP MUST accept and discard the associated
 		message data before sending the appropriate 5XX or 4XX code.
 	*/
-	resp := make([]byte, chunkSize64)
-	if n, err := s.bufio.Read(resp); err != nil {
-		s.Out(fmt.Sprintf(Codes.FailReadErrorDataCmd, err))
-		s.state = sessionStateAborted
-		return
-	} else if int64(n) != chunkSize64 {
-		s.Out(fmt.Sprintf(Codes.FailReadErrorDataCmd, err))
-		s.state = sessionStateAborted
-		return
+	var fail string
+	switch {
+	case len(args) > 2 || (len(args) == 2 && !last):
+		fail = Codes.FailInvalidBdatCmd
+	case s.state == sessionStateReadyForData:
+		// first chunk of the message
+		if err := s.envelope.BeginData(); err != nil {
+			fail = err.Error()
+			break
+		}
+		s.chunked = 0
+		s.state = sessionStateGettingData
+		s.beginMessage()
+	case s.state != sessionStateGettingData:
+		/*
+			Any BDAT command sent after the BDAT LAST is illegal and
+			MUST be replied to with a 503 "Bad sequence of commands" reply code.
+		*/
+		fail = Codes.FailBadSequence
 	}
 
-	n, err := s.envelope.Write(resp)
-	if int64(n) != chunkSize64 {
+	w := &chunkWriter{w: io.Discard}
+	if fail == "" {
+		w.w = s.messageWriter()
+		if limit := s.listener.Limits.MsgSize; limit > 0 && s.chunked+size > limit {
+			w.err = errMessageTooBig
+		}
+	}
+	s.setReadDeadline(time.Now().Add(s.listener.Limits.MsgInput))
+	if _, err := io.CopyN(w, s.bufio, size); err != nil {
+		s.discardMessage(err)
 		s.Out(fmt.Sprintf(Codes.FailReadErrorDataCmd, err))
 		s.state = sessionStateAborted
 		return
 	}
-
-	if last {
-		// data done
-		s.Out(fmt.Sprintf("250 BDAT ok, BDAT finished, %d octets received", s.envelope.data.Len()))
-		s.envelope.Close()
-		s.state = sessionStateDataDone
-	} else {
+	s.chunked += size
+
+	switch {
+	case fail != "":
+		if s.state == sessionStateGettingData {
+			// the chunk is lost, the message can't be completed
+			s.discardMessage(errors.New(fail))
+			s.resetForwarded()
+			s.Reset()
+		}
+		s.Out(fail)
+		return
+	case w.err == errMessageTooBig:
+		s.discardMessage(w.err)
+		s.Out(Codes.FailTooBig)
+		s.resetForwarded()
+		s.Reset()
+		return
+	case w.err != nil && w.err != errStreamClosed:
+		s.discardMessage(w.err)
+		s.Out(fmt.Sprintf(Codes.FailReadErrorDataCmd, w.err))
+		s.resetForwarded()
+		s.Reset()
+		return
+	case !last:
 		/*
 			A 250 response MUST be sent to each successful BDAT data block within
 			a mail transaction.
 		*/
-		s.Out(fmt.Sprintf("250 BDAT ok, %d octets received", chunkSize64))
+		s.Out(fmt.Sprintf("%s %d", Codes.SuccessBdatCmd, size))
+		return
 	}
+
+	// data done, BINARYMIME data are passed on as they were received
+	s.deliverMessage()
+	s.resetForwarded()
+	s.Reset()
 }
-func handleExpn(s *session, _ *command) {
-	s.Out("252")
+
+// chunkWriter writes BDAT chunk to w, once writing fails the rest is discarded so the whole chunk is read
+type chunkWriter struct {
+	w   io.Writer
+	err error
 }
 
-// authMechanismValid checks if selected authentication mechanism is available
-func (s *session) authMechanismValid(mech string) bool {
-	mech = strings.ToUpper(mech)
-	for _, m := range s.srv.authMechanisms {
-		if mech == m {
-			return true
-		}
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(p)
 	}
-	return false
+	return len(p), nil
 }
 
-func handleAuth(s *session, cmd *command) {
-	if !s.tls {
-		// Don't even allow unsecure authentication
-		s.Out(Codes.FailEncryptionNeeded)
-		return
-	}
+// notDigit is used to check chunk size contains only digits
+func notDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
 
-	// should not happen, some auth is always allowed
-	if len(s.srv.authMechanisms) == 0 {
+func handleExpn(s *session, _ *command) {
+	s.Out("252")
+}
+
+func handleAuth(s *session, cmd *command) {
+	// AUTH is disabled, the listener has no TLS or no mechanism is offered in this session,
+	// e.g. only EXTERNAL without client certificate
+	if !s.extensionEnabled(ExtAuth) {
 		s.Out(Codes.FailCmdNotSupported)
 		// AUTH with no AUTH enabled counts as a
 		// bad command. This deals with a few people
@@ -762,6 +1032,12 @@ func handleAuth(s *session, cmd *command) {
 		return
 	}
 
+	if !s.tls {
+		// Don't even allow unsecure authentication
+		s.Out(Codes.FailEncryptionNeeded)
+		return
+	}
+
 	// if authenticatedUser is already
 	if s.peer.Authenticated {
 		// RFC4954, section 4: After an AUTH
@@ -772,25 +1048,23 @@ func handleAuth(s *session, cmd *command) {
 		return
 	}
 
-	args := cmd.arguments
-	if len(args) == 0 {
-		s.Out(Codes.FailMissingArgument)
+	// RFC4954, section 4: The AUTH command is not permitted during a mail transaction.
+	if s.envelope.IsSet() {
+		s.Out(Codes.FailBadSequence)
 		return
 	}
-	if !s.authMechanismValid(strings.ToUpper(args[0])) {
-		s.Out(Codes.ErrorCmdParamNotImplemented)
+
+	args := cmd.arguments
+	if len(args) == 0 || len(args) > 2 {
+		s.Out(Codes.FailMissingArgument)
 		return
 	}
-
-	switch strings.ToUpper(args[0]) {
-	case "PLAIN":
-		s.handlePlainAuth(cmd)
-	case "LOGIN":
-		s.handleLoginAuth(cmd)
-	default:
+	mech := s.authMechanism(args[0])
+	if mech == nil {
 		s.Out(Codes.ErrorCmdParamNotImplemented)
 		return
 	}
+	s.handleSASL(mech, args)
 }
 
 func (s *session) ReceivedHeader() []byte {
@@ -808,13 +1082,17 @@ func (s *session) ReceivedHeader() []byte {
 		The gateway SHOULD indicate the environment and protocol in the "via"
 		clauses of Received header field(s) that it supplies.
 	*/
-	remoteIP := strings.Split(s.conn.RemoteAddr().String(), ":")[0]
-	remotePort := strings.Split(s.conn.RemoteAddr().String(), ":")[1]
+	remoteIP, remotePort := splitHostPort(s.peer.Addr)
 	remoteHost := "no reverse"
-	if remoteHosts, err := net.LookupAddr(remoteIP); err == nil {
+	if s.peer.RemoteName != "" {
+		remoteHost = s.peer.RemoteName
+	} else if remoteHosts, err := net.LookupAddr(remoteIP); err == nil {
 		remoteHost = remoteHosts[0]
 	}
-	localIP := strings.Split(s.conn.LocalAddr().String(), ":")[0]
+	if remotePort != "" {
+		remoteIP += ":" + remotePort
+	}
+	localIP, _ := splitHostPort(s.conn.LocalAddr())
 	localHost := "no reverse"
 	localHosts, err := net.LookupAddr(localIP)
 	if err == nil {
@@ -830,7 +1108,7 @@ func (s *session) ReceivedHeader() []byte {
 	}
 
 	// host and IP
-	receivedHeader.WriteString(fmt.Sprintf("%s (%s:%s %s)", remoteHost, remoteIP, remotePort, auth))
+	receivedHeader.WriteString(fmt.Sprintf("%s (%s %s)", remoteHost, remoteIP, auth))
 
 	// TLS
 	if s.tls {
@@ -840,10 +1118,15 @@ func (s *session) ReceivedHeader() []byte {
 	// local
 	receivedHeader.WriteString(fmt.Sprintf(" by %s (%s)", localIP, localHost))
 
-	// proto
-	if s.tls {
+	// proto, https://tools.ietf.org/html/rfc6531#section-3.7.3
+	switch {
+	case s.envelope.SMTPUTF8 && s.tls:
+		receivedHeader.WriteString(" with UTF8SMTPS; ")
+	case s.envelope.SMTPUTF8:
+		receivedHeader.WriteString(" with UTF8SMTP; ")
+	case s.tls:
 		receivedHeader.WriteString(" with ESMTPS; ")
-	} else {
+	default:
 		receivedHeader.WriteString(" with SMTP; ")
 	}
 
@@ -856,6 +1139,17 @@ func (s *session) ReceivedHeader() []byte {
 	return wrap(receivedHeader.Bytes())
 }
 
+// rejectConnection rejects session over the concurrent sessions limits, TLS client is disconnected
+// without reply as the handshake didn't happen yet
+func (s *session) rejectConnection() {
+	s.log.Printf("INFO: too many connections, rejecting %s", s.peer.Addr)
+	if _, ok := s.conn.(*tls.Conn); ok || s.listener.TLSMode == TLSImplicit {
+		s.state = sessionStateAborted
+		return
+	}
+	s.Reject()
+}
+
 func (s *session) Reject() {
 	s.Out("421 Too busy. Try again later.")
 	s.state = sessionStateAborted
@@ -877,6 +1171,9 @@ var handlers = []func(s *session, cmd *command){
 	handleHelp,
 	handleAuth,
 	handleBdat,
+	handleXclient,
+	handleXforward,
+	handleLhlo,
 }
 
 // http://www.rfc-base.org/txt/rfc-4408.txt
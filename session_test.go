@@ -1,13 +1,16 @@
 package gosmtp
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"strings"
@@ -24,8 +27,11 @@ func dummyChecker(peer *Peer, mail *mail.Address) error {
 	return nil
 }
 
+// testServer serves sessions of the tests over in-memory connections
+var testServer *Server
+
 func init() {
-	srv, err := NewServer(":4344", log.New(os.Stdout, "", log.LstdFlags))
+	srv, err := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
 	if err != nil {
 		panic(err)
 	}
@@ -33,37 +39,23 @@ func init() {
 	srv.Handler = dummyHandle
 	srv.RecipientChecker = dummyChecker
 	srv.Hostname = "test.com"
+	testServer = srv
+}
 
-	go func() {
-		err := srv.ListenAndServe()
-		if err != nil {
-			panic(err)
-		}
-	}()
-
-	//cert, err := tls.LoadX509KeyPair("./cert.pem", "./key.pem")
-	//config := &tls.Config{Certificates: []tls.Certificate{cert}}
-	//srv2, err := NewServer(":4345", log.New(os.Stdout, "", log.LstdFlags))
-	//if err != nil {
-	//	panic(err)
-	//}
-	//
-	//srv2.Handler = dummyHandle
-	//srv2.RecipientChecker = dummyChecker
-	//srv2.Hostname = "securetest.com"
-	//srv2.TLSConfig = config
-	//srv2.TLSOnly = true
-	//
-	//go func() {
-	//	err := srv2.ListenAndServe()
-	//	if err != nil {
-	//		panic(err)
-	//	}
-	//}()
+// testDial starts new session of srv over in-memory connection and returns the client end of it
+func testDial(srv *Server) net.Conn {
+	client, server := net.Pipe()
+	go srv.ServeConn(server)
+	return client
+}
+
+// testClient returns net/smtp client connected to srv over in-memory connection
+func testClient(srv *Server) (*smtp.Client, error) {
+	return smtp.NewClient(testDial(srv), "localhost")
 }
 
 func TestSession_ExtensionBDAT(t *testing.T) {
-	conn, err := smtp.Dial("localhost:4344")
+	conn, err := testClient(testServer)
 	if err != nil {
 		panic(err)
 	}
@@ -102,22 +94,19 @@ func TestSession_ExtensionBDAT(t *testing.T) {
 }
 
 func TestSession_ExtensionSTARTTLS(t *testing.T) {
-	_, err := smtp.Dial("localhost:4344")
+	_, err := testClient(testServer)
 	if err != nil {
 		panic(err)
 	}
 }
 
 func TestSession_ExtensionHELP(t *testing.T) {
-	conn, err := net.Dial("tcp", "localhost:4344")
-	if err != nil {
-		panic(err)
-	}
+	conn := testDial(testServer)
 
 	x := make([]byte, 1000)
 	conn.Read(x)
 
-	_, err = conn.Write([]byte("EHLO it's me\r\n"))
+	_, err := conn.Write([]byte("EHLO it's me\r\n"))
 	assert.NoError(t, err, "error when sending HELLO")
 	conn.Read(x)
 
@@ -129,15 +118,12 @@ func TestSession_ExtensionHELP(t *testing.T) {
 }
 
 func TestSession_ExtensionPIPELINING(t *testing.T) {
-	conn, err := net.Dial("tcp", "localhost:4344")
-	if err != nil {
-		panic(err)
-	}
+	conn := testDial(testServer)
 
 	x := make([]byte, 1000)
 	conn.Read(x)
 
-	_, err = conn.Write([]byte("EHLO it's me\r\n"))
+	_, err := conn.Write([]byte("EHLO it's me\r\n"))
 	assert.NoError(t, err, "error when sending HELLO")
 
 	conn.Read(x)
@@ -151,7 +137,7 @@ func TestSession_ExtensionPIPELINING(t *testing.T) {
 }
 
 func TestSession_ExtensionSMTPUTF8(t *testing.T) {
-	conn, err := smtp.Dial("localhost:4344")
+	conn, err := testClient(testServer)
 	if err != nil {
 		panic(err)
 	}
@@ -183,7 +169,7 @@ func TestSession_ExtensionSMTPUTF8(t *testing.T) {
 }
 
 func TestSession_Postmaster(t *testing.T) {
-	conn, err := smtp.Dial("localhost:4344")
+	conn, err := testClient(testServer)
 	if err != nil {
 		panic(err)
 	}
@@ -202,7 +188,7 @@ func TestSession_Postmaster(t *testing.T) {
 }
 
 func TestSession_Serve(t *testing.T) {
-	conn, err := smtp.Dial("localhost:4344")
+	conn, err := testClient(testServer)
 	if err != nil {
 		panic(err)
 	}
@@ -213,7 +199,7 @@ func TestSession_Serve(t *testing.T) {
 	err = conn.Quit()
 	assert.NoError(t, err, "error when quiting the connection")
 
-	conn, err = smtp.Dial("localhost:4344")
+	conn, err = testClient(testServer)
 	if err != nil {
 		panic(err)
 	}
@@ -241,7 +227,7 @@ func TestSession_Serve(t *testing.T) {
 }
 
 func TestSession_handleEhlo(t *testing.T) {
-	conn, err := smtp.Dial("localhost:4344")
+	conn, err := testClient(testServer)
 	if err != nil {
 		panic(err)
 	}
@@ -270,3 +256,124 @@ func TestSession_handleEhlo(t *testing.T) {
 	has, _ = conn.Extension("SIZE")
 	assert.True(t, has, "gosmtp should support SIZE")
 }
+
+func TestSession_ErrorReplies(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Hostname = "test.com"
+	srv.HeloChecker = func(peer *Peer, name string) error {
+		if name == "spammer" {
+			return NewError(554, ClassPermanentFailure, DeliveryNotAuthorized, "Go away")
+		}
+		return nil
+	}
+	srv.SenderChecker = func(peer *Peer, addr *mail.Address) error {
+		if addr.Address == "spammer@localhost" {
+			return errors.New("not a Error")
+		}
+		return nil
+	}
+	srv.RecipientChecker = func(peer *Peer, addr *mail.Address) error {
+		switch addr.Address {
+		case "full@localhost":
+			return ErrorRecipientsMailboxFull
+		case "later@localhost":
+			return fmt.Errorf("greylisting: %w", NewError(450, ClassTransientFailure, DeliveryNotAuthorized, "Try again later"))
+		}
+		return nil
+	}
+	srv.Handler = func(peer *Peer, env *Envelope) (string, error) {
+		return "", NewError(554, ClassPermanentFailure, OtherOrUndefinedMediaError, "Message rejected")
+	}
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+
+	_, msg, _ := testCmd(c, 554, "EHLO spammer")
+	assert.Equal(t, "5.7.1 Go away", msg, "HELO checker Error should be replied")
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+
+	_, msg, _ = testCmd(c, 554, "MAIL FROM:<spammer@localhost>")
+	assert.Contains(t, msg, "not a Error", "other errors should be appended to the generic reply")
+	_, _, err = testCmd(c, 250, "MAIL FROM:<sender@localhost>")
+	assert.NoError(t, err)
+	_, msg, _ = testCmd(c, 552, "RCPT TO:<full@localhost>")
+	assert.Equal(t, "5.2.2 Recipients mailbox is full", msg)
+	_, msg, _ = testCmd(c, 450, "RCPT TO:<later@localhost>")
+	assert.Equal(t, "4.7.1 Try again later", msg)
+	_, _, err = testCmd(c, 250, "RCPT TO:<user@localhost>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, msg, _ = testCmd(c, 554, "Subject: test\r\n\r\nHello\r\n.")
+	assert.Equal(t, "5.6.0 Message rejected", msg, "Handler Error should be replied")
+}
+
+func TestSession_BDAT(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Limits.MsgSize = 40
+	received := make(chan string, 1)
+	srv.Handler = func(peer *Peer, env *Envelope) (string, error) {
+		received <- string(env.Bytes())
+		return "bdat-id", nil
+	}
+
+	conn := testDial(srv)
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	transaction := func() {
+		for _, cmd := range []string{"MAIL FROM:<a@localhost> BODY=BINARYMIME", "RCPT TO:<b@localhost>"} {
+			_, _, err := testCmd(c, 250, cmd)
+			assert.NoError(t, err)
+		}
+	}
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+
+	// testCmd terminates the chunks by CRLF, which is counted in the chunk sizes below
+	// chunk arriving in pieces is read whole, binary data are kept as they are
+	transaction()
+	c.W.WriteString("BDAT 13\r\nSubject:")
+	c.W.Flush()
+	time.Sleep(10 * time.Millisecond)
+	c.W.WriteString(" x\n\r\n")
+	c.W.Flush()
+	_, _, err = c.ReadResponse(250)
+	assert.NoError(t, err)
+	_, msg, err := testCmd(c, 250, "BDAT 6 LAST\r\n.\r\nx")
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "bdat-id")
+	assert.Equal(t, "Subject: x\n\r\n.\r\nx\r\n", <-received)
+
+	// DATA can't be mixed with BDAT
+	transaction()
+	_, _, err = testCmd(c, 250, "BDAT 5\r\nabc")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 503, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RSET")
+	assert.NoError(t, err)
+
+	// the size is cumulative, the rejected chunk is discarded and the session continues
+	transaction()
+	_, _, err = testCmd(c, 250, "BDAT 32\r\n"+strings.Repeat("x", 30))
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 552, "BDAT 22 LAST\r\n"+strings.Repeat("x", 20))
+	assert.NoError(t, err)
+
+	// chunk without transaction is discarded
+	_, _, err = testCmd(c, 503, "BDAT 6 LAST\r\nRSET")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "RSET")
+	assert.NoError(t, err)
+
+	// invalid chunk size ends the session
+	_, _, err = testCmd(c, 501, "BDAT x")
+	assert.NoError(t, err)
+	_, err = c.ReadLine()
+	assert.Error(t, err)
+}
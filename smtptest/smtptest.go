@@ -0,0 +1,115 @@
+/*
+Package smtptest provides utilities for testing gosmtp servers without binding real network ports.
+Sessions are served over in-memory connections created by net.Pipe.
+*/
+package smtptest
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+
+	"github.com/matoous/gosmtp"
+)
+
+// Dial starts new session of srv over in-memory connection and returns the client end of it
+func Dial(srv *gosmtp.Server) net.Conn {
+	client, server := net.Pipe()
+	go srv.ServeConn(server)
+	return client
+}
+
+// NewClient returns net/smtp client connected to srv over in-memory connection
+func NewClient(srv *gosmtp.Server) (*smtp.Client, error) {
+	return smtp.NewClient(Dial(srv), "localhost")
+}
+
+// Conn is raw text connection to the server, useful for sending arbitrary
+// commands and checking the exact replies
+type Conn struct {
+	*textproto.Conn
+}
+
+// NewConn connects to srv over in-memory connection and reads the greeting
+func NewConn(srv *gosmtp.Server) (*Conn, error) {
+	c := &Conn{textproto.NewConn(Dial(srv))}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Send sends the command and reads the reply, if the reply code doesn't match
+// expectCode, returned error is *textproto.Error
+func (c *Conn) Send(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	return c.ReadResponse(expectCode)
+}
+
+// ErrListenerClosed is returned by Listener after it was closed
+var ErrListenerClosed = errors.New("smtptest: listener closed")
+
+// Listener is in-memory net.Listener, new connections are created by Dial
+// It can be passed to Server.Serve to test accept loop and shutdown without network
+type Listener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewListener creates new in-memory listener
+func NewListener() *Listener {
+	return &Listener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the listener, pending Dial and Accept calls are unblocked
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the listener's network address
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial creates new connection to the listener and returns the client end of it
+func (l *Listener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,76 @@
+package smtptest
+
+import (
+	"context"
+	"log"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matoous/gosmtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer() *gosmtp.Server {
+	srv, err := gosmtp.NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	if err != nil {
+		panic(err)
+	}
+	srv.Hostname = "test.com"
+	return srv
+}
+
+func TestNewClient(t *testing.T) {
+	c, err := NewClient(newTestServer())
+	assert.NoError(t, err, "client should read the greeting")
+	assert.NoError(t, c.Hello("localhost"))
+	ok, _ := c.Extension("PIPELINING")
+	assert.True(t, ok)
+	assert.NoError(t, c.Quit())
+}
+
+func TestConn_Send(t *testing.T) {
+	c, err := NewConn(newTestServer())
+	assert.NoError(t, err, "connection should read the greeting")
+
+	code, _, err := c.Send(250, "RSET")
+	assert.NoError(t, err)
+	assert.Equal(t, 250, code)
+
+	_, _, err = c.Send(250, "NONSENSE")
+	assert.Error(t, err)
+	assert.IsType(t, &textproto.Error{}, err, "unexpected code should be reported as textproto.Error")
+
+	_, _, err = c.Send(221, "QUIT")
+	assert.NoError(t, err)
+}
+
+func TestListener(t *testing.T) {
+	srv := newTestServer()
+	ln := NewListener()
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ln)
+	}()
+
+	conn, err := ln.Dial()
+	assert.NoError(t, err)
+	c := textproto.NewConn(conn)
+	_, _, err = c.ReadResponse(220)
+	assert.NoError(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	code, _, _ := c.ReadResponse(0)
+	assert.Equal(t, 421, code, "idle session should be closed upon shutdown")
+	assert.NoError(t, <-shutdown)
+	assert.Equal(t, gosmtp.ErrServerClosed, <-done)
+
+	_, err = ln.Dial()
+	assert.Equal(t, ErrListenerClosed, err, "closed listener shouldn't accept connections")
+}
@@ -0,0 +1,85 @@
+package gosmtp
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+/*
+RFC 6531, SMTP Extension for Internationalized Email
+
+	Mailbox        =/ Uchar-local-part "@" ( Domain / address-literal )
+	atext          =/ UTF8-non-ascii
+	qtextSMTP      =/ UTF8-non-ascii
+	sub-domain     =/ U-label
+
+The UTF-8 addresses are allowed only in transactions started by MAIL command with SMTPUTF8 parameter,
+otherwise they are rejected with 553 5.6.7. Domains are IDNA validated and stored as U-labels in SMTPUTF8
+transactions and as A-labels otherwise, so the same domain always has the same form within one envelope.
+*/
+
+var errNonASCIIAddress = errors.New("non-ASCII address without SMTPUTF8")
+
+// normalizeMailbox validates UTF-8 mailbox returned by the path parser and normalizes its domain,
+// non-ASCII mailbox is allowed only if smtputf8 is set
+func normalizeMailbox(mailbox string, smtputf8 bool) (string, error) {
+	if !utf8.ValidString(mailbox) {
+		return "", errInvalidPath
+	}
+	i := strings.LastIndexByte(mailbox, '@')
+	if i < 0 {
+		// the null sender or bare postmaster
+		return mailbox, nil
+	}
+	local, domain := mailbox[:i], mailbox[i+1:]
+	if !smtputf8 && !isall7bit([]byte(mailbox)) {
+		return "", errNonASCIIAddress
+	}
+	if strings.HasPrefix(domain, "[") || (isall7bit([]byte(domain)) && !hasALabel(domain)) {
+		return mailbox, nil
+	}
+
+	var err error
+	if smtputf8 {
+		domain, err = idna.Lookup.ToUnicode(domain)
+	} else {
+		domain, err = idna.Lookup.ToASCII(domain)
+	}
+	if err != nil {
+		return "", errInvalidPath
+	}
+	return local + "@" + domain, nil
+}
+
+// hasALabel checks if the domain has an IDNA A-label, e.g. xn--bcher-kva.example
+func hasALabel(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) > 4 && strings.EqualFold(label[:4], "xn--") {
+			return true
+		}
+	}
+	return false
+}
+
+// AddressToASCII converts domain of the address to A-labels, it fails for address with non-ASCII local part,
+// which can't be delivered to server without SMTPUTF8 support
+func AddressToASCII(address string) (string, error) {
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 || strings.HasPrefix(address[i+1:], "[") {
+		if !isall7bit([]byte(address)) {
+			return "", errNonASCIIAddress
+		}
+		return address, nil
+	}
+	if !isall7bit([]byte(address[:i])) {
+		return "", errNonASCIIAddress
+	}
+	domain, err := idna.Lookup.ToASCII(address[i+1:])
+	if err != nil {
+		return "", err
+	}
+	return address[:i] + "@" + domain, nil
+}
@@ -0,0 +1,85 @@
+package gosmtp
+
+import (
+	"log"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeMailbox(t *testing.T) {
+	for _, c := range []struct {
+		mailbox, expected string
+		smtputf8          bool
+		err               error
+	}{
+		{"user@example.com", "user@example.com", false, nil},
+		{"user@xn--bcher-kva.example", "user@xn--bcher-kva.example", false, nil},
+		{"user@Bücher.example", "", false, errNonASCIIAddress},
+		{"Pelé@example.com", "", false, errNonASCIIAddress},
+		{"user@Bücher.example", "user@bücher.example", true, nil},
+		{"user@xn--bcher-kva.example", "user@bücher.example", true, nil},
+		{"测试@测试.测试", "测试@测试.测试", true, nil},
+		{"Pelé@[127.0.0.1]", "Pelé@[127.0.0.1]", true, nil},
+		{"user@xn--a.example", "", false, errInvalidPath},
+		{"us\xffer@example.com", "", true, errInvalidPath},
+	} {
+		mailbox, err := normalizeMailbox(c.mailbox, c.smtputf8)
+		assert.Equal(t, c.err, err, c.mailbox)
+		assert.Equal(t, c.expected, mailbox, c.mailbox)
+	}
+}
+
+func TestAddressToASCII(t *testing.T) {
+	addr, err := AddressToASCII("user@bücher.example")
+	assert.NoError(t, err)
+	assert.Equal(t, "user@xn--bcher-kva.example", addr)
+	_, err = AddressToASCII("测试@example.com")
+	assert.Error(t, err, "UTF-8 local part can't be downgraded")
+}
+
+func TestSession_SMTPUTF8(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	envs := make(chan *Envelope, 1)
+	srv.Handler = func(peer *Peer, env *Envelope) (string, error) {
+		envs <- &Envelope{MailFrom: env.MailFrom, MailTo: env.MailTo, SMTPUTF8: env.SMTPUTF8}
+		return "", nil
+	}
+
+	c := textproto.NewConn(testDial(srv))
+	defer c.Close()
+	_, _, err := c.ReadResponse(220)
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "EHLO localhost")
+	assert.NoError(t, err)
+
+	_, _, err = testCmd(c, 553, "MAIL FROM:<pelé@[127.0.0.1]>")
+	assert.NoError(t, err, "UTF-8 address needs SMTPUTF8")
+	_, _, err = testCmd(c, 501, "MAIL FROM:<pelé@[127.0.0.1]> SMTPUTF8=yes")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "MAIL FROM:<pelé@[127.0.0.1]> SMTPUTF8")
+	assert.NoError(t, err)
+	for _, cmd := range []string{"RCPT TO:<测试@测试.测试>", "RCPT TO:<user@xn--bcher-kva.example>"} {
+		_, _, err = testCmd(c, 250, cmd)
+		assert.NoError(t, err)
+	}
+	_, _, err = testCmd(c, 354, "DATA")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "Subject: ünïcödé\r\n.")
+	assert.NoError(t, err)
+
+	env := <-envs
+	assert.True(t, env.SMTPUTF8)
+	assert.False(t, env.CanDowngrade())
+	assert.Equal(t, "pelé@[127.0.0.1]", env.MailFrom.Address)
+	assert.Equal(t, "测试@测试.测试", env.MailTo[0].Address)
+	assert.Equal(t, "user@bücher.example", env.MailTo[1].Address, "domains should be U-labels in SMTPUTF8 transaction")
+
+	// the flag is only for the transaction
+	_, _, err = testCmd(c, 250, "MAIL FROM:<a@localhost>")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 553, "RCPT TO:<测试@测试.测试>")
+	assert.NoError(t, err)
+}
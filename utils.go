@@ -3,7 +3,10 @@ package gosmtp
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/signalsciences/tlstext"
@@ -36,6 +39,61 @@ func removeBrackets(s string) string {
 	return s
 }
 
+// splitHostPort splits network address into host and port, addresses
+// without port (pipes, unix sockets) are returned whole as the host
+func splitHostPort(addr net.Addr) (host, port string) {
+	if addr == nil {
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), ""
+	}
+	return host, port
+}
+
+// addrInNetworks checks if the IP address belongs to one of the networks
+func addrInNetworks(addr net.Addr, networks []*net.IPNet) bool {
+	host, _ := splitHostPort(addr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeXtext decodes xtext encoded string (RFC 3461, section 4), in xtext
+// the "+" character is followed by two upper case hexadecimal digits
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return "", fmt.Errorf("malformed xtext: %s", s)
+			}
+			v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(v))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("malformed xtext: %s", s)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isUpperHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F')
+}
+
 func limitedLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	dropCR := func(data []byte) []byte {
 		if len(data) > 0 && data[len(data)-1] == '\r' {
@@ -102,3 +160,9 @@ func wrap(sl []byte) []byte {
 	}
 	return sl
 }
+
+// isTimeout checks if the error is network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
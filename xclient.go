@@ -0,0 +1,223 @@
+package gosmtp
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+Postfix XCLIENT and XFORWARD extensions
+http://www.postfix.org/XCLIENT_README.html
+http://www.postfix.org/XFORWARD_README.html
+
+XCLIENT allows SMTP proxy to override the client information as if the original client
+connected directly, the session starts over with new greeting. XFORWARD allows content
+filter to pass on the original client information which is used only for logging and
+headers of the following mail transaction.
+Both commands are available only to clients from Server.TrustedNetworks.
+*/
+
+const (
+	xclientAttrs  = "NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT"
+	xforwardAttrs = "NAME ADDR PORT PROTO HELO IDENT SOURCE"
+
+	xUnavailable = "[UNAVAILABLE]"
+	xTempUnavail = "[TEMPUNAVAIL]"
+)
+
+// forwardedPeer holds peer fields which were overridden by XFORWARD
+type forwardedPeer struct {
+	Addr       net.Addr
+	RemoteName string
+	HeloName   string
+	Protocol   Protocol
+}
+
+// parseXattrs parses and xtext decodes the attribute=value list of XCLIENT and XFORWARD commands
+func parseXattrs(args []string, allowed string) (map[string]string, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	attrs := make(map[string]string, len(args))
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+		name := strings.ToUpper(kv[0])
+		if !stringInSlice(name, strings.Split(allowed, " ")) {
+			return nil, false
+		}
+		value, err := decodeXtext(kv[1])
+		if err != nil {
+			return nil, false
+		}
+		attrs[name] = value
+	}
+	return attrs, true
+}
+
+// xattrAvailable returns false for the [UNAVAILABLE] and [TEMPUNAVAIL] values
+func xattrAvailable(value string) bool {
+	return !strings.EqualFold(value, xUnavailable) && !strings.EqualFold(value, xTempUnavail)
+}
+
+// applyXaddr sets the peer address from the ADDR and PORT attributes
+func applyXaddr(peer *Peer, attrs map[string]string) bool {
+	host, port := splitHostPort(peer.Addr)
+	ip := net.ParseIP(host)
+	if addr, ok := attrs["ADDR"]; ok && xattrAvailable(addr) {
+		if len(addr) > 5 && strings.EqualFold(addr[:5], "IPV6:") {
+			addr = addr[5:]
+		}
+		if ip = net.ParseIP(addr); ip == nil {
+			return false
+		}
+	}
+	if p, ok := attrs["PORT"]; ok && xattrAvailable(p) {
+		port = p
+	}
+	if ip == nil {
+		// no usable address to update
+		return true
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil && port != "" {
+		return false
+	}
+	peer.Addr = &net.TCPAddr{IP: ip, Port: int(portNum)}
+	return true
+}
+
+// applyXcommon applies attributes shared by XCLIENT and XFORWARD
+func applyXcommon(peer *Peer, attrs map[string]string) bool {
+	if !applyXaddr(peer, attrs) {
+		return false
+	}
+	if name, ok := attrs["NAME"]; ok {
+		if !xattrAvailable(name) {
+			name = ""
+		}
+		peer.RemoteName = name
+	}
+	if helo, ok := attrs["HELO"]; ok {
+		if !xattrAvailable(helo) {
+			helo = ""
+		}
+		peer.HeloName = helo
+	}
+	if proto, ok := attrs["PROTO"]; ok && xattrAvailable(proto) {
+		switch strings.ToUpper(proto) {
+		case "SMTP":
+			peer.Protocol = SMTP
+		case "ESMTP":
+			peer.Protocol = ESMTP
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// handleXclient overrides the client information and starts the session over
+func handleXclient(s *session, cmd *command) {
+	if !s.xclientTrusted {
+		s.Out(Codes.FailXclientNotAuthorized)
+		return
+	}
+	if !s.extensionEnabled(ExtXClient) {
+		s.Out(Codes.FailCmdNotSupported)
+		s.badCommandsCount++
+		return
+	}
+	if s.envelope.IsSet() {
+		s.Out(Codes.FailTransactionInProgress)
+		return
+	}
+	attrs, ok := parseXattrs(cmd.arguments, xclientAttrs)
+	if !ok {
+		s.Out(Codes.FailInvalidExtension)
+		s.badCommandsCount++
+		return
+	}
+
+	peer := *s.peer
+	if !applyXcommon(&peer, attrs) {
+		s.Out(Codes.FailInvalidExtension)
+		s.badCommandsCount++
+		return
+	}
+	if login, ok := attrs["LOGIN"]; ok {
+		if xattrAvailable(login) {
+			peer.Username = login
+			peer.Authenticated = true
+		} else {
+			peer.Username = ""
+			peer.Authenticated = false
+		}
+	}
+	*s.peer = peer
+	s.log.Printf("INFO: XCLIENT from %s, client is now %s", s.conn.RemoteAddr(), s.peer.Addr)
+
+	// as if the client connected right now, HELO/EHLO has to be sent again
+	_, s.xclientHelo = attrs["HELO"]
+	_, s.xclientProto = attrs["PROTO"]
+	s.forwarded = nil
+	s.helloSeen = false
+	s.Reset()
+	s.handleWelcome()
+}
+
+// handleXforward overrides the client information for the following mail transaction
+func handleXforward(s *session, cmd *command) {
+	if !s.xclientTrusted {
+		s.Out(Codes.FailXclientNotAuthorized)
+		return
+	}
+	if !s.extensionEnabled(ExtXForward) {
+		s.Out(Codes.FailCmdNotSupported)
+		s.badCommandsCount++
+		return
+	}
+	if s.envelope.IsSet() {
+		s.Out(Codes.FailTransactionInProgress)
+		return
+	}
+	attrs, ok := parseXattrs(cmd.arguments, xforwardAttrs)
+	if !ok {
+		s.Out(Codes.FailInvalidExtension)
+		s.badCommandsCount++
+		return
+	}
+
+	peer := *s.peer
+	if !applyXcommon(&peer, attrs) {
+		s.Out(Codes.FailInvalidExtension)
+		s.badCommandsCount++
+		return
+	}
+	// remember what the peer looked like before the first XFORWARD of this transaction
+	if s.forwarded == nil {
+		s.forwarded = &forwardedPeer{
+			Addr:       s.peer.Addr,
+			RemoteName: s.peer.RemoteName,
+			HeloName:   s.peer.HeloName,
+			Protocol:   s.peer.Protocol,
+		}
+	}
+	*s.peer = peer
+	s.Out(Codes.SuccessXforwardCmd)
+}
+
+// resetForwarded restores the peer information overridden by XFORWARD after the transaction
+func (s *session) resetForwarded() {
+	if s.forwarded == nil {
+		return
+	}
+	s.peer.Addr = s.forwarded.Addr
+	s.peer.RemoteName = s.forwarded.RemoteName
+	s.peer.HeloName = s.forwarded.HeloName
+	s.peer.Protocol = s.forwarded.Protocol
+	s.forwarded = nil
+}
@@ -0,0 +1,119 @@
+package gosmtp
+
+import (
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeXtext(t *testing.T) {
+	s, err := decodeXtext("user+2Bname+3D@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "user+name=@example.com", s)
+
+	for _, bad := range []string{"a+2", "a+2b", "a b", "a=b"} {
+		_, err = decodeXtext(bad)
+		assert.Error(t, err, "xtext %q should be rejected", bad)
+	}
+}
+
+func TestSession_Xclient(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	srv.Handler = dummyHandle
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv.TrustedNetworks = []*net.IPNet{loopback}
+	peers := make(chan Peer, 10)
+	srv.ConnectionChecker = func(peer *Peer) error {
+		peers <- *peer
+		return nil
+	}
+	srv.SenderChecker = func(peer *Peer, addr *mail.Address) error {
+		peers <- *peer
+		return nil
+	}
+	defer srv.Close()
+	addr := startTestListener(t, srv, Listener{})
+
+	c, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	c.ReadResponse(220)
+	<-peers
+	_, msg, err := testCmd(c, 250, "EHLO proxy.example.com")
+	assert.NoError(t, err)
+	assert.Contains(t, msg, "XCLIENT NAME ADDR", "XCLIENT should be offered to trusted network")
+	assert.Contains(t, msg, "XFORWARD NAME ADDR", "XFORWARD should be offered to trusted network")
+
+	_, _, err = testCmd(c, 220, "XCLIENT NAME=client.example.com ADDR=IPV6:2001:db8::1 PORT=1234 HELO=client.example.com LOGIN=joe+40example.com PROTO=ESMTP")
+	assert.NoError(t, err, "XCLIENT should restart the session with new greeting")
+	peer := <-peers
+	assert.Equal(t, "[2001:db8::1]:1234", peer.Addr.String(), "connection checker should see XCLIENT address")
+	assert.Equal(t, "client.example.com", peer.RemoteName)
+	assert.Equal(t, "client.example.com", peer.HeloName)
+	assert.Equal(t, "joe@example.com", peer.Username)
+	assert.True(t, peer.Authenticated)
+
+	// HELO name provided by XCLIENT is kept
+	testCmd(c, 250, "EHLO proxy.example.com")
+	testCmd(c, 250, "MAIL FROM:<sender@localhost>")
+	peer = <-peers
+	assert.Equal(t, "client.example.com", peer.HeloName)
+
+	_, _, err = testCmd(c, 503, "XCLIENT ADDR=192.0.2.1")
+	assert.NoError(t, err, "XCLIENT shouldn't be allowed in the middle of transaction")
+	testCmd(c, 250, "RSET")
+	_, _, err = testCmd(c, 501, "XCLIENT FOO=bar")
+	assert.NoError(t, err, "unknown attribute should be rejected")
+	c.Close()
+}
+
+func TestSession_Xforward(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv.TrustedNetworks = []*net.IPNet{loopback}
+	peers := make(chan Peer, 10)
+	srv.SenderChecker = func(peer *Peer, addr *mail.Address) error {
+		peers <- *peer
+		return nil
+	}
+	defer srv.Close()
+	addr := startTestListener(t, srv, Listener{})
+
+	c, err := textproto.Dial("tcp", addr)
+	assert.NoError(t, err)
+	c.ReadResponse(220)
+	testCmd(c, 250, "EHLO filter.example.com")
+	_, _, err = testCmd(c, 250, "XFORWARD ADDR=192.0.2.7 PORT=2525 NAME=[UNAVAILABLE]")
+	assert.NoError(t, err)
+	_, _, err = testCmd(c, 250, "XFORWARD HELO=client.example.com")
+	assert.NoError(t, err, "XFORWARD attributes can be split to several commands")
+	testCmd(c, 250, "MAIL FROM:<sender@localhost>")
+	peer := <-peers
+	assert.Equal(t, "192.0.2.7:2525", peer.Addr.String(), "sender checker should see forwarded address")
+	assert.Equal(t, "client.example.com", peer.HeloName)
+
+	// forwarded information is valid only for one transaction
+	testCmd(c, 250, "RSET")
+	testCmd(c, 250, "MAIL FROM:<sender@localhost>")
+	peer = <-peers
+	assert.Equal(t, "127.0.0.1", peer.Addr.(*net.TCPAddr).IP.String())
+	assert.Equal(t, "filter.example.com", peer.HeloName)
+	c.Close()
+}
+
+func TestSession_XclientUntrusted(t *testing.T) {
+	srv, _ := NewServer("", log.New(os.Stdout, "", log.LstdFlags))
+	c := textproto.NewConn(testDial(srv))
+	c.ReadResponse(220)
+	_, msg, _ := testCmd(c, 250, "EHLO client.example.com")
+	assert.NotContains(t, msg, "XCLIENT", "XCLIENT shouldn't be offered to untrusted client")
+	_, _, err := testCmd(c, 550, "XCLIENT ADDR=192.0.2.1")
+	assert.NoError(t, err, "XCLIENT should be refused for untrusted client")
+	_, _, err = testCmd(c, 550, "XFORWARD ADDR=192.0.2.1")
+	assert.NoError(t, err, "XFORWARD should be refused for untrusted client")
+	c.Close()
+}